@@ -8,16 +8,20 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/bitly/go-simplejson"
-	"github.com/cxr29/log"
 	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/internal/csrfutil"
 	"github.com/meilihao/water-contrib/session"
-	"github.com/seefan/gossdb"
 )
 
 var (
+	_ csrfer = &Csrf{}
+
+	// _csrfer is used by the package-level functions, it's kept for
+	// compatibility, use the middleware of Csrf instead
 	_csrfer csrfer
 )
 
@@ -30,38 +34,56 @@ type csrfer interface {
 	Error(*water.Context)
 }
 
+// Init sets the instance used by GenerateToken and ValidateToken.
 func Init(c csrfer) {
 	_csrfer = c
 }
 
+// GenerateToken generates token by the instance set by Init.
 func GenerateToken(ctx *water.Context) {
 	_csrfer.GenerateToken(ctx)
 }
 
+// ValidateToken validates token by the instance set by Init.
 func ValidateToken(ctx *water.Context) {
+	validate(_csrfer, ctx)
+}
+
+func validate(c csrfer, ctx *water.Context) {
 	var ok bool
 
-	token := _csrfer.Token(ctx)
-	if token != "" && _csrfer.ValidateToken(ctx, token) {
+	token := c.Token(ctx)
+	if token != "" && c.ValidateToken(ctx, token) {
 		ok = true
 	}
 
 	if !ok {
-		_csrfer.Error(ctx)
+		c.Error(ctx)
 	}
 }
 
-type csrf struct {
+// Csrf is a csrf instance, its Generate and Validate are middleware, so
+// routers can be protected by different instances.
+type Csrf struct {
 	// csrf location : Header|Form
 	From string
 	// csrf name
 	Name string
+	// Field and Header are the names of the token in form(csrfField) and
+	// header(csrfMeta), default is Name
+	Field, Header string
 	// to generato token
 	TokenGenerator TokenGenerator
 	// csrf's store
 	Store Store
 	// handle invalid token
 	ErrorFunc func(*water.Context)
+	// token is used once
+	OneTime bool
+	// token binding : Session|Path|Action
+	Bind string
+	// max outstanding tokens of a binding in OneTime mode
+	PoolSize int
 }
 
 type TokenGenerator interface {
@@ -73,59 +95,183 @@ type Store interface {
 	Set(key, value string) bool
 }
 
-func (c *csrf) GenerateToken(ctx *water.Context) {
-	token := c.TokenGenerator.Gen()
+// Consumer is implemented by stores which can keep a pool of one-time tokens
+// atomically, other stores keep it by Get and Set.
+type Consumer interface {
+	// Add adds token to the pool of key, the oldest ones are dropped over size
+	Add(key, token string, size int) bool
+	// Consume removes token from the pool of key, it reports whether token is in the pool
+	Consume(key, token string) bool
+}
+
+// poolSep joins tokens of a pool, tokens never contain it
+const poolSep = "|"
 
-	if ok := c.Store.Set(session.Get(ctx).Id+"_"+ctx.Req.URL.Path, token); !ok {
-		token = ""
+// Generate is the middleware generating token.
+func (c *Csrf) Generate(ctx *water.Context) {
+	c.GenerateToken(ctx)
+}
+
+// Validate is the middleware validating token, ErrorFunc is called on failure.
+func (c *Csrf) Validate(ctx *water.Context) {
+	validate(c, ctx)
+}
+
+// key returns the store key of the binding, action is the page path in "Path".
+func (c *Csrf) key(ctx *water.Context, action string) string {
+	id := session.Get(ctx).Id
+	if c.Bind == "Session" {
+		return id
 	}
+	return id + "_" + action
+}
+
+func (c *Csrf) GenerateToken(ctx *water.Context) {
+	token := c.GenerateFor(ctx, ctx.Req.URL.Path)
 
 	if c.From == "Header" {
-		ctx.ResponseWriter.Header().Add(c.Name, token)
+		ctx.ResponseWriter.Header().Add(c.header(), token)
 	} else {
 		ctx.Environ.Set(c.Name, token)
 	}
 }
 
-func (c *csrf) Token(ctx *water.Context) string {
-	switch c.From {
-	case "Form":
-		return ctx.Req.FormValue(c.Name)
+// Token returns the unmasked token of the request, it's read from the header
+// and then the form, so both helpers of FuncMap are accepted.
+func (c *Csrf) Token(ctx *water.Context) string {
+	token := ctx.Req.Header.Get(c.header())
+	if token == "" {
+		token = ctx.Req.FormValue(c.field())
+	}
+	return csrfutil.Unmask(token)
+}
+
+func (c *Csrf) field() string {
+	if c.Field != "" {
+		return c.Field
+	}
+	return c.Name
+}
+
+func (c *Csrf) header() string {
+	if c.Header != "" {
+		return c.Header
+	}
+	return c.Name
+}
+
+// GenerateFor generates token for a form posting to action, e.g. in
+// templates when the form posts to another path than the page. Only "Action"
+// binding accepts such an action, "Path" binds token to the page path, and
+// "Session" ignores action. It returns "" on failure.
+func (c *Csrf) GenerateFor(ctx *water.Context, action string) string {
+	if i := strings.IndexByte(action, '?'); i >= 0 {
+		action = action[:i]
+	}
+	if c.Bind == "Path" && action != ctx.Req.URL.Path {
+		return ""
+	}
+
+	token := c.TokenGenerator.Gen()
+	key := c.key(ctx, action)
+
+	var ok bool
+	switch {
+	case !c.OneTime:
+		ok = c.Store.Set(key, token)
+	case c.consumer() != nil:
+		ok = c.consumer().Add(key, token, c.PoolSize)
 	default:
-		return ctx.Req.Header.Get(c.Name)
+		ls := append(splitPool(c.Store.Get(key)), token)
+		if len(ls) > c.PoolSize {
+			ls = ls[len(ls)-c.PoolSize:]
+		}
+		ok = c.Store.Set(key, strings.Join(ls, poolSep))
 	}
+	if !ok {
+		return ""
+	}
+	return token
 }
 
-func (c *csrf) ValidateToken(ctx *water.Context, token string) bool {
-	tmp := c.Store.Get(session.Get(ctx).Id + "_" + ctx.Req.URL.Path)
-	if tmp == "" {
+func (c *Csrf) ValidateToken(ctx *water.Context, token string) bool {
+	if token == "" || strings.Contains(token, poolSep) {
 		return false
 	}
+	key := c.key(ctx, ctx.Req.URL.Path)
+
+	if !c.OneTime {
+		tmp := c.Store.Get(key)
+		if tmp == "" {
+			return false
+		}
+
+		return tmp == token
+	}
+
+	if consumer := c.consumer(); consumer != nil {
+		return consumer.Consume(key, token)
+	}
+
+	// it isn't atomic, concurrent requests may use a token twice
+	ls := splitPool(c.Store.Get(key))
+	for i, v := range ls {
+		if v == token {
+			c.Store.Set(key, strings.Join(append(ls[:i], ls[i+1:]...), poolSep))
+			return true
+		}
+	}
+	return false
+}
 
-	return tmp == token
+func (c *Csrf) consumer() Consumer {
+	consumer, _ := c.Store.(Consumer)
+	return consumer
 }
 
-func (c *csrf) Error(ctx *water.Context) {
+func splitPool(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, poolSep)
+}
+
+func (c *Csrf) Error(ctx *water.Context) {
 	c.ErrorFunc(ctx)
 }
 
-func NewCsrf(config string, errorFunc func(*water.Context), store Store, tg TokenGenerator) csrfer {
+// NewCsrf creates a csrf instance.
+func NewCsrf(config string, errorFunc func(*water.Context), store Store, tg TokenGenerator) (*Csrf, error) {
 	if errorFunc == nil || store == nil || tg == nil {
-		log.Fatalln("csrf : wrong ErrorFunc,Store or TokenGenerator")
+		return nil, errors.New("csrf : wrong ErrorFunc,Store or TokenGenerator")
 	}
 	js, err := simplejson.NewJson([]byte(config))
 	if err != nil {
-		log.Fatalln("csrf : wrong config : ", err)
+		return nil, fmt.Errorf("csrf : wrong config : %v", err)
 	}
 
-	c := new(csrf)
+	c := new(Csrf)
 	c.ErrorFunc = errorFunc
 	c.Store = store
 	c.TokenGenerator = tg
 	c.From = js.Get("From").MustString("Header")
 	c.Name = js.Get("Name").MustString("CrsfToken")
+	c.Field = js.Get("Field").MustString()
+	c.Header = js.Get("Header").MustString()
+	c.OneTime = js.Get("OneTime").MustBool(false)
+	c.Bind = js.Get("Bind").MustString("Path")
+	c.PoolSize = js.Get("PoolSize").MustInt(5)
+
+	switch c.Bind {
+	case "Session", "Path", "Action":
+	default:
+		return nil, fmt.Errorf("csrf : wrong Bind : %s", c.Bind)
+	}
+	if c.PoolSize < 1 {
+		return nil, errors.New("csrf : PoolSize must be >= 1")
+	}
 
-	return c
+	return c, nil
 }
 
 type defaultTokenGenerator struct {
@@ -143,89 +289,3 @@ func NewDefaultTokenGenerator() TokenGenerator {
 
 	return tg
 }
-
-type defaulStore struct {
-	pool *gossdb.Connectors
-	// csrf's prefix in store
-	prefix string
-	// csrf's expire time
-	maxAge int64
-}
-
-func NewDefaultStore(config string) (Store, error) {
-	js, err := simplejson.NewJson([]byte(config))
-	if err != nil {
-		return nil, err
-	}
-
-	pool, err := gossdb.NewPool(&gossdb.Config{
-		Host:             js.Get("SSDB").Get("Host").MustString(""),
-		Port:             js.Get("SSDB").Get("Port").MustInt(0),
-		MinPoolSize:      js.Get("SSDB").Get("MinPoolSize").MustInt(0),
-		MaxPoolSize:      js.Get("SSDB").Get("MaxPoolSize").MustInt(0),
-		AcquireIncrement: js.Get("SSDB").Get("AcquireIncrement").MustInt(0),
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return NewDefaultStoreByInstance(pool, js.Get("Prefix").MustString("csrf_"), js.Get("MaxAge").MustInt64(24*3600))
-}
-
-func NewDefaultStoreByInstance(pool *gossdb.Connectors, prefix string, maxAge int64) (Store, error) {
-	ssdbStore := &defaulStore{}
-	ssdbStore.pool = pool
-
-	client, err := ssdbStore.pool.NewClient()
-	if err != nil {
-		return nil, err
-	}
-	defer client.Close()
-
-	if !client.Ping() {
-		return nil, errors.New("csrf : ssdb error: wrong config.")
-	}
-
-	ssdbStore.prefix = prefix
-	ssdbStore.maxAge = maxAge
-
-	if ssdbStore.prefix == "" {
-		return nil, errors.New("csrf : empty prefix")
-	}
-
-	return ssdbStore, nil
-}
-
-func (s *defaulStore) Get(key string) string {
-	c, err := s.pool.NewClient()
-	if err != nil {
-		log.Errorln(err)
-		return ""
-	}
-	defer c.Close()
-
-	v, err := c.Get(s.prefix + key)
-	if err != nil {
-		log.Errorln(err)
-		return ""
-	}
-
-	return v.String()
-}
-
-func (s *defaulStore) Set(key, value string) bool {
-	c, err := s.pool.NewClient()
-	if err != nil {
-		log.Errorln(err)
-		return false
-	}
-	defer c.Close()
-
-	err = c.Set(s.prefix+key, value, s.maxAge)
-	if err != nil {
-		log.Errorln(err)
-		return false
-	}
-
-	return true
-}
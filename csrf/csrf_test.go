@@ -3,16 +3,20 @@
 package csrf
 
 import (
+	"bytes"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"testing"
 	"time"
 
 	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/cache"
+	"github.com/meilihao/water-contrib/internal/csrfutil"
 	"github.com/meilihao/water-contrib/session"
-	"github.com/meilihao/water-contrib/session/ssdb"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -22,57 +26,35 @@ var store Store
 
 func init() {
 	// first,init session
-	sessionStore, err := ssdbstore.New(`
-{
-    "SSDB":{
-        "Host":"127.0.0.1",
-        "Port":8888,
-        "MinPoolSize":5,
-        "MaxPoolSize":50,
-        "AcquireIncrement":5
-    },
-    "Prefix":"sssdb_",
-    "MaxAge":0
-}`)
-	if err != nil {
-		log.Fatalln("init session store err: ", err)
-	}
-
 	manager := new(session.Options)
 	manager.Generator = session.NewSha1Generator("test")
 	manager.Tracker = session.NewCookieTracker("session", 0, false, "/", ".test.com")
 	manager.OnSessionNew = nil
 	manager.OnSessionRelease = nil
-	manager.Store = sessionStore
+	manager.Store = session.NewMemoryStore(0)
 	sessionManager = manager
 
-	csrfStore, err := NewDefaultStore(`{
-    "SSDB":{
-        "Host":"127.0.0.1",
-        "Port":8888,
-        "MinPoolSize":5,
-        "MaxPoolSize":50,
-        "AcquireIncrement":5
-    },
-    "Prefix":"csrf_",
-    "MaxAge":0
-}`)
-	if err != nil {
-		log.Fatalln("init csrf store err: ", err)
-	}
-	store = csrfStore
+	store = NewMemoryStore(3)
 
 	errFunc = func(ctx *water.Context) {
 		ctx.BadRequest()
 	}
 }
 
+func mustNewCsrf(config string) *Csrf {
+	c, err := NewCsrf(config, errFunc, store, NewDefaultTokenGenerator())
+	if err != nil {
+		log.Fatalln("init csrf err: ", err)
+	}
+	return c
+}
+
 // recommend
 func Test_GenerateHeader(t *testing.T) {
-	Init(NewCsrf(`{
+	Init(mustNewCsrf(`{
 		"From":"Header",
 		"Name":"CrsfToken"
-		}`, errFunc, store, NewDefaultTokenGenerator()))
+		}`))
 	Convey("Generate token to header", t, func() {
 		w := water.NewRouter()
 		w.Before(session.New(sessionManager))
@@ -104,10 +86,10 @@ func Test_GenerateHeader(t *testing.T) {
 }
 
 func Test_GenerateForm(t *testing.T) {
-	Init(NewCsrf(`{
+	Init(mustNewCsrf(`{
 		"From":"Form",
 		"Name":"CrsfToken"
-		}`, errFunc, store, NewDefaultTokenGenerator()))
+		}`))
 	Convey("Generate token", t, func() {
 		w := water.NewRouter()
 		w.Before(session.New(sessionManager))
@@ -137,10 +119,10 @@ func Test_GenerateForm(t *testing.T) {
 }
 
 func Test_ValidateHeader(t *testing.T) {
-	Init(NewCsrf(`{
+	Init(mustNewCsrf(`{
 		"From":"Header",
 		"Name":"CrsfToken"
-		}`, errFunc, store, NewDefaultTokenGenerator()))
+		}`))
 	Convey("Validate using right token from Header", t, func() {
 		w := water.NewRouter()
 		w.Before(session.New(sessionManager))
@@ -202,10 +184,10 @@ func Test_ValidateHeader(t *testing.T) {
 }
 
 func Test_ValidateForm(t *testing.T) {
-	Init(NewCsrf(`{
+	Init(mustNewCsrf(`{
 		"From":"Form",
 		"Name":"CrsfToken"
-		}`, errFunc, store, NewDefaultTokenGenerator()))
+		}`))
 	Convey("Validate using right token from Form", t, func() {
 		w := water.NewRouter()
 		w.Before(session.New(sessionManager))
@@ -268,10 +250,10 @@ func Test_ValidateForm(t *testing.T) {
 }
 
 func Test_ValidateTimeout(t *testing.T) {
-	Init(NewCsrf(`{
+	Init(mustNewCsrf(`{
 		"From":"Header",
 		"Name":"CrsfToken"
-		}`, errFunc, store, NewDefaultTokenGenerator()))
+		}`))
 	Convey("Validate using right token but timeout", t, func() {
 		w := water.NewRouter()
 		w.Before(session.New(sessionManager))
@@ -307,3 +289,242 @@ func Test_ValidateTimeout(t *testing.T) {
 		So(resp.Code, ShouldEqual, http.StatusBadRequest)
 	})
 }
+
+func Test_NewCsrf(t *testing.T) {
+	Convey("Wrong arguments return errors", t, func() {
+		_, err := NewCsrf(`{}`, nil, store, NewDefaultTokenGenerator())
+		So(err, ShouldNotBeNil)
+
+		_, err = NewCsrf(`{`, errFunc, store, NewDefaultTokenGenerator())
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func Test_Store(t *testing.T) {
+	Convey("Memory store expires tokens", t, func() {
+		s := NewMemoryStore(1)
+		So(s.Set("a", "token"), ShouldBeTrue)
+		So(s.Get("a"), ShouldEqual, "token")
+		So(s.Get("b"), ShouldBeEmpty)
+
+		time.Sleep(1100 * time.Millisecond)
+		So(s.Get("a"), ShouldBeEmpty)
+
+		// the gc isn't run after Close
+		So(s.Close(), ShouldBeNil)
+		So(s.Set("c", "token"), ShouldBeTrue)
+		time.Sleep(1100 * time.Millisecond)
+		s.lock.RLock()
+		_, ok := s.items["c"]
+		s.lock.RUnlock()
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("Cache store", t, func() {
+		_, err := NewCacheStore(nil, "csrf_", 60)
+		So(err, ShouldNotBeNil)
+
+		c := cache.NewMemoryCache()
+		s, err := NewCacheStore(c, "csrf_", 60)
+		So(err, ShouldBeNil)
+		So(s.Set("a", "token"), ShouldBeTrue)
+		So(s.Get("a"), ShouldEqual, "token")
+		So(c.Get("csrf_a"), ShouldEqual, "token")
+		So(s.Get("b"), ShouldBeEmpty)
+	})
+}
+
+func Test_Instances(t *testing.T) {
+	Convey("Routers protected by different instances", t, func() {
+		admin, err := NewCsrf(`{"From":"Header","Name":"X-Admin-Token"}`, errFunc, NewMemoryStore(60), NewDefaultTokenGenerator())
+		So(err, ShouldBeNil)
+		site, err := NewCsrf(`{"From":"Header","Name":"X-Site-Token"}`, errFunc, NewMemoryStore(60), NewDefaultTokenGenerator())
+		So(err, ShouldBeNil)
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Get("/admin", admin.Generate)
+		w.Post("/admin", admin.Validate)
+		w.Get("/site", site.Generate)
+		w.Post("/site", site.Validate)
+
+		serve := func(method, path, cookie, name, token string) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, nil)
+			if cookie != "" {
+				req.Header.Set("Cookie", cookie)
+			}
+			if name != "" {
+				req.Header.Set(name, token)
+			}
+			w.ServeHTTP(resp, req)
+			return resp
+		}
+
+		resp := serve("GET", "/admin", "", "", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		adminToken := resp.Header().Get("X-Admin-Token")
+		So(adminToken, ShouldNotBeEmpty)
+
+		So(serve("POST", "/admin", cookie, "X-Admin-Token", adminToken).Code, ShouldEqual, http.StatusOK)
+		// the site instance neither reads the header nor knows the token
+		So(serve("POST", "/site", cookie, "X-Admin-Token", adminToken).Code, ShouldEqual, http.StatusBadRequest)
+		So(serve("POST", "/site", cookie, "X-Site-Token", adminToken).Code, ShouldEqual, http.StatusBadRequest)
+	})
+}
+
+func Test_OneTime(t *testing.T) {
+	newRouter := func(c *Csrf) *water.Router {
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Get("/form", c.Generate)
+		w.Get("/page", func(ctx *water.Context) {
+			ctx.ResponseWriter.Header().Set(c.Name, c.GenerateFor(ctx, "/save?next=/"))
+		})
+		w.Post("/form", c.Validate)
+		w.Post("/save", c.Validate)
+		return w
+	}
+	serve := func(w *water.Router, method, path, cookie, token string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		if token != "" {
+			req.Header.Set("CrsfToken", token)
+		}
+		w.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for _, s := range []Store{NewMemoryStore(60), mustCacheStore()} {
+		Convey(fmt.Sprintf("Token is used once by %T", s), t, func() {
+			c, err := NewCsrf(`{"OneTime":true,"PoolSize":2}`, errFunc, s, NewDefaultTokenGenerator())
+			So(err, ShouldBeNil)
+			w := newRouter(c)
+
+			resp := serve(w, "GET", "/form", "", "")
+			cookie := resp.Header().Get("Set-Cookie")
+			token1 := resp.Header().Get("CrsfToken")
+
+			// another tab
+			token2 := serve(w, "GET", "/form", cookie, "").Header().Get("CrsfToken")
+
+			So(serve(w, "POST", "/form", cookie, token1).Code, ShouldEqual, http.StatusOK)
+			So(serve(w, "POST", "/form", cookie, token1).Code, ShouldEqual, http.StatusBadRequest)
+			So(serve(w, "POST", "/form", cookie, token2).Code, ShouldEqual, http.StatusOK)
+
+			Convey("Oldest token is dropped over PoolSize", func() {
+				var tokens []string
+				for i := 0; i < 3; i++ {
+					tokens = append(tokens, serve(w, "GET", "/form", cookie, "").Header().Get("CrsfToken"))
+				}
+				So(serve(w, "POST", "/form", cookie, tokens[0]).Code, ShouldEqual, http.StatusBadRequest)
+				So(serve(w, "POST", "/form", cookie, tokens[2]).Code, ShouldEqual, http.StatusOK)
+			})
+		})
+	}
+
+	Convey("Binding", t, func() {
+		c, err := NewCsrf(`{"OneTime":true,"Bind":"Action"}`, errFunc, NewMemoryStore(60), NewDefaultTokenGenerator())
+		So(err, ShouldBeNil)
+		w := newRouter(c)
+
+		resp := serve(w, "GET", "/page", "", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := resp.Header().Get("CrsfToken")
+		So(serve(w, "POST", "/form", cookie, token).Code, ShouldEqual, http.StatusBadRequest)
+		So(serve(w, "POST", "/save", cookie, token).Code, ShouldEqual, http.StatusOK)
+
+		// "Path" binds to the page, the token of the page isn't valid for /save
+		c, err = NewCsrf(`{"Bind":"Path"}`, errFunc, NewMemoryStore(60), NewDefaultTokenGenerator())
+		So(err, ShouldBeNil)
+		w = newRouter(c)
+		w.Get("/save", c.Generate)
+
+		resp = serve(w, "GET", "/form", "", "")
+		cookie = resp.Header().Get("Set-Cookie")
+		token = resp.Header().Get("CrsfToken")
+		So(serve(w, "GET", "/page", cookie, "").Header().Get("CrsfToken"), ShouldBeEmpty)
+		So(serve(w, "POST", "/save", cookie, token).Code, ShouldEqual, http.StatusBadRequest)
+		So(serve(w, "POST", "/form", cookie, token).Code, ShouldEqual, http.StatusOK)
+		token = serve(w, "GET", "/save", cookie, "").Header().Get("CrsfToken")
+		So(serve(w, "POST", "/save", cookie, token).Code, ShouldEqual, http.StatusOK)
+
+		c, err = NewCsrf(`{"Bind":"Session"}`, errFunc, NewMemoryStore(60), NewDefaultTokenGenerator())
+		So(err, ShouldBeNil)
+		w = newRouter(c)
+
+		resp = serve(w, "GET", "/form", "", "")
+		cookie = resp.Header().Get("Set-Cookie")
+		token = resp.Header().Get("CrsfToken")
+		So(serve(w, "POST", "/save", cookie, token).Code, ShouldEqual, http.StatusOK)
+		So(serve(w, "POST", "/form", cookie, token).Code, ShouldEqual, http.StatusOK)
+
+		_, err = NewCsrf(`{"Bind":"Cookie"}`, errFunc, NewMemoryStore(60), NewDefaultTokenGenerator())
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func mustCacheStore() Store {
+	s, err := NewCacheStore(cache.NewMemoryCache(), "csrf_", 60)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return s
+}
+
+func Test_FuncMap(t *testing.T) {
+	Convey("Render masked token by template helpers", t, func() {
+		c := mustNewCsrf(`{"From":"Form","Name":"CrsfToken"}`)
+		tpl := template.Must(template.New("form").Funcs(c.FuncMap()).Parse(
+			`<form>{{csrfField .}}</form>{{csrfMeta .}}{{csrfScript}}`))
+		render := func(token string) string {
+			var buf bytes.Buffer
+			So(tpl.Execute(&buf, token), ShouldBeNil)
+			return buf.String()
+		}
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+
+		page := ""
+		w.Get("/test5", c.Generate, func(ctx *water.Context) {
+			page = render(ctx.Environ.GetString(c.Name))
+		})
+		w.Post("/test5", c.Validate)
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/test5", nil)
+		So(err, ShouldBeNil)
+		w.ServeHTTP(resp, req)
+		cookie := resp.Header().Get("Set-Cookie")
+
+		So(page, ShouldContainSubstring, `<meta name="csrf-header" content="CrsfToken">`)
+		So(page, ShouldContainSubstring, "<script>")
+		m := regexp.MustCompile(`name="CrsfToken" value="([^"]+)"`).FindStringSubmatch(page)
+		So(m, ShouldHaveLength, 2)
+		So(m[1], ShouldStartWith, csrfutil.MaskPrefix)
+
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("POST", "/test5?CrsfToken="+m[1], nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		w.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+
+		// the script sends the token of csrfMeta by header in "Form" too
+		meta := regexp.MustCompile(`name="csrf-token" content="([^"]+)"`).FindStringSubmatch(page)
+		So(meta, ShouldHaveLength, 2)
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("POST", "/test5", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("CrsfToken", meta[1])
+		w.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+
+		So(render(""), ShouldContainSubstring, `value=""`)
+	})
+}
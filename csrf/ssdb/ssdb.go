@@ -0,0 +1,102 @@
+// Copyright 2016 The Water Authors
+
+package ssdbstore
+
+import (
+	"errors"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/cxr29/log"
+	"github.com/seefan/gossdb"
+)
+
+// SsdbStore represents a ssdb csrf store implementation, it implements
+// csrf.Store, which is checked by package csrf for its deprecated wrappers.
+type SsdbStore struct {
+	pool *gossdb.Connectors
+	// csrf's prefix in store
+	prefix string
+	// csrf's expire time
+	maxAge int64
+}
+
+// New creates a store by config, e.g.
+// {"SSDB":{"Host":"127.0.0.1","Port":8888},"Prefix":"csrf_","MaxAge":86400}
+func New(config string) (*SsdbStore, error) {
+	js, err := simplejson.NewJson([]byte(config))
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := gossdb.NewPool(&gossdb.Config{
+		Host:             js.Get("SSDB").Get("Host").MustString(""),
+		Port:             js.Get("SSDB").Get("Port").MustInt(0),
+		MinPoolSize:      js.Get("SSDB").Get("MinPoolSize").MustInt(0),
+		MaxPoolSize:      js.Get("SSDB").Get("MaxPoolSize").MustInt(0),
+		AcquireIncrement: js.Get("SSDB").Get("AcquireIncrement").MustInt(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewByInstance(pool, js.Get("Prefix").MustString("csrf_"), js.Get("MaxAge").MustInt64(24*3600))
+}
+
+// NewByInstance creates a store by an existing pool.
+func NewByInstance(pool *gossdb.Connectors, prefix string, maxAge int64) (*SsdbStore, error) {
+	ssdbStore := &SsdbStore{}
+	ssdbStore.pool = pool
+
+	client, err := ssdbStore.pool.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	if !client.Ping() {
+		return nil, errors.New("csrf : ssdb error: wrong config.")
+	}
+
+	ssdbStore.prefix = prefix
+	ssdbStore.maxAge = maxAge
+
+	if ssdbStore.prefix == "" {
+		return nil, errors.New("csrf : empty prefix")
+	}
+
+	return ssdbStore, nil
+}
+
+func (s *SsdbStore) Get(key string) string {
+	c, err := s.pool.NewClient()
+	if err != nil {
+		log.Errorln(err)
+		return ""
+	}
+	defer c.Close()
+
+	v, err := c.Get(s.prefix + key)
+	if err != nil {
+		log.Errorln(err)
+		return ""
+	}
+
+	return v.String()
+}
+
+func (s *SsdbStore) Set(key, value string) bool {
+	c, err := s.pool.NewClient()
+	if err != nil {
+		log.Errorln(err)
+		return false
+	}
+	defer c.Close()
+
+	err = c.Set(s.prefix+key, value, s.maxAge)
+	if err != nil {
+		log.Errorln(err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 The Water Authors
+
+package ssdbstore
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Store(t *testing.T) {
+	Convey("Set and get token", t, func() {
+		store, err := New(`
+{
+    "SSDB":{
+        "Host":"127.0.0.1",
+        "Port":8888,
+        "MinPoolSize":5,
+        "MaxPoolSize":50,
+        "AcquireIncrement":5
+    },
+    "Prefix":"csrf_test_",
+    "MaxAge":60
+}`)
+		So(err, ShouldBeNil)
+
+		So(store.Set("a", "token"), ShouldBeTrue)
+		So(store.Get("a"), ShouldEqual, "token")
+		So(store.Get("b"), ShouldBeEmpty)
+
+		_, err = New(`{"Prefix":1`)
+		So(err, ShouldNotBeNil)
+	})
+}
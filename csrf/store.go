@@ -0,0 +1,209 @@
+// Copyright 2016 The Water Authors
+
+package csrf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cxr29/log"
+	"github.com/meilihao/water-contrib/cache"
+	"github.com/meilihao/water-contrib/csrf/ssdb"
+	"github.com/seefan/gossdb"
+)
+
+var (
+	_ Store    = &MemoryStore{}
+	_ Consumer = &MemoryStore{}
+	_ Store    = &CacheStore{}
+	_ Store    = &ssdbstore.SsdbStore{}
+)
+
+// NewDefaultStore creates a ssdb csrf store.
+//
+// Deprecated: use ssdbstore.New of package csrf/ssdb.
+func NewDefaultStore(config string) (Store, error) {
+	s, err := ssdbstore.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewDefaultStoreByInstance creates a ssdb csrf store by an existing pool.
+//
+// Deprecated: use ssdbstore.NewByInstance of package csrf/ssdb.
+func NewDefaultStoreByInstance(pool *gossdb.Connectors, prefix string, maxAge int64) (Store, error) {
+	s, err := ssdbstore.NewByInstance(pool, prefix, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type memoryItem struct {
+	value  string
+	expire time.Time
+}
+
+// MemoryStore represents a memory csrf store implementation, it is suitable
+// for single process and tests.
+type MemoryStore struct {
+	lock   sync.RWMutex
+	items  map[string]*memoryItem
+	maxAge time.Duration
+	gc     *time.Timer
+	closed bool
+}
+
+// NewMemoryStore creates and returns a memory csrf store, tokens expire after
+// maxAge seconds, default is 24 hours. Close stops its gc.
+func NewMemoryStore(maxAge int64) *MemoryStore {
+	if maxAge <= 0 {
+		maxAge = 24 * 3600
+	}
+
+	s := &MemoryStore{
+		items:  make(map[string]*memoryItem),
+		maxAge: time.Duration(maxAge) * time.Second,
+	}
+	s.lock.Lock()
+	s.gc = time.AfterFunc(s.maxAge, s.startGC)
+	s.lock.Unlock()
+	return s
+}
+
+func (s *MemoryStore) Get(key string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	item, ok := s.items[key]
+	if !ok || time.Now().After(item.expire) {
+		return ""
+	}
+	return item.value
+}
+
+func (s *MemoryStore) Set(key, value string) bool {
+	s.lock.Lock()
+	s.items[key] = &memoryItem{value: value, expire: time.Now().Add(s.maxAge)}
+	s.lock.Unlock()
+	return true
+}
+
+func (s *MemoryStore) Add(key, token string, size int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ls []string
+	if item, ok := s.items[key]; ok && !time.Now().After(item.expire) {
+		ls = splitPool(item.value)
+	}
+	ls = append(ls, token)
+	if len(ls) > size {
+		ls = ls[len(ls)-size:]
+	}
+
+	s.items[key] = &memoryItem{value: strings.Join(ls, poolSep), expire: time.Now().Add(s.maxAge)}
+	return true
+}
+
+func (s *MemoryStore) Consume(key, token string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	item, ok := s.items[key]
+	if !ok || time.Now().After(item.expire) {
+		return false
+	}
+
+	ls := splitPool(item.value)
+	for i, v := range ls {
+		if v == token {
+			item.value = strings.Join(append(ls[:i], ls[i+1:]...), poolSep)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) startGC() {
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, item := range s.items {
+		if now.After(item.expire) {
+			delete(s.items, key)
+		}
+	}
+
+	if !s.closed {
+		s.gc = time.AfterFunc(s.maxAge, s.startGC)
+	}
+}
+
+// Close stops the gc of the store.
+func (s *MemoryStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	s.gc.Stop()
+	return nil
+}
+
+// CacheStore represents a csrf store implementation by a cache adapter.
+type CacheStore struct {
+	cache  cache.Cache
+	prefix string
+	maxAge int64
+}
+
+// NewCacheStore creates and returns a csrf store writing to c, tokens expire
+// after maxAge seconds.
+func NewCacheStore(c cache.Cache, prefix string, maxAge int64) (*CacheStore, error) {
+	if c == nil {
+		return nil, errors.New("csrf : nil cache")
+	}
+	if prefix == "" {
+		return nil, errors.New("csrf : empty prefix")
+	}
+	if maxAge <= 0 {
+		return nil, errors.New("csrf : cache store need MaxAge > 0")
+	}
+
+	return &CacheStore{
+		cache:  c,
+		prefix: prefix,
+		maxAge: maxAge,
+	}, nil
+}
+
+func (s *CacheStore) Get(key string) string {
+	switch v := s.cache.Get(s.prefix + key).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		// e.g. gossdb.Value of cache/ssdb
+		return v.String()
+	default:
+		log.Errorln("csrf : unknown cache value type", fmt.Sprintf("%T", v))
+		return ""
+	}
+}
+
+func (s *CacheStore) Set(key, value string) bool {
+	if err := s.cache.Put(s.prefix+key, value, s.maxAge); err != nil {
+		log.Errorln(err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 The Water Authors
+
+package csrf
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/session"
+)
+
+const clientIdLen = 16
+
+// id returns the id tokens are bound to: the session id if the session
+// middleware is used, or a random client id kept by ClientCookie.
+func (c *csrf) id(ctx *water.Context) string {
+	if sess := session.Get(ctx); sess != nil {
+		return sess.Id
+	}
+
+	if id := ctx.Environ.GetString("CSRFClient"); id != "" {
+		return id
+	}
+	id := ctx.Cookie(c.ClientCookie)
+	if !c.validClientId(id) {
+		if id = c.newClientId(); id == "" {
+			return ""
+		}
+		// a browser session cookie, tokens are limited by TTL
+		ctx.SetCookie(c.ClientCookie, id, 0, c.Cookie.Path, c.Cookie.Domain, c.Cookie.Secure, true)
+	}
+	ctx.Environ.Set("CSRFClient", id)
+	return id
+}
+
+// The client id is base64(random) "." base64(mac), it's signed so a forged
+// cookie can't be used.
+func (c *csrf) newClientId() string {
+	bs := make([]byte, clientIdLen)
+	if _, err := rand.Read(bs); err != nil {
+		return ""
+	}
+	v := base64.RawURLEncoding.EncodeToString(bs)
+	return v + "." + base64.RawURLEncoding.EncodeToString(signClientId(c.Keys[0], v))
+}
+
+func (c *csrf) validClientId(id string) bool {
+	i := strings.IndexByte(id, '.')
+	if i < 0 {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(id[i+1:])
+	if err != nil {
+		return false
+	}
+
+	for _, k := range c.Keys {
+		if hmac.Equal(mac, signClientId(k, id[:i])) {
+			return true
+		}
+	}
+	return false
+}
+
+func signClientId(k Key, v string) []byte {
+	h := hmac.New(sha256.New, []byte(k.Secret))
+	h.Write([]byte("client\x00"))
+	h.Write([]byte(v))
+	return h.Sum(nil)
+}
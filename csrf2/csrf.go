@@ -8,7 +8,7 @@ import (
 
 	"github.com/meilihao/goutil"
 	"github.com/meilihao/water"
-	"github.com/meilihao/water-contrib/session"
+	"github.com/meilihao/water-contrib/internal/csrfutil"
 )
 
 var (
@@ -20,14 +20,6 @@ var (
 		From:   "Header",
 		Name:   "X-CSRF",
 		Cookie: http.Cookie{},
-		NoFunc: func(ctx *water.Context) {
-			ctx.Forbidden()
-			ctx.WriteString("csrf : no token")
-		},
-		ErrorFunc: func(ctx *water.Context) {
-			ctx.Forbidden()
-			ctx.WriteString("csrf : bad token")
-		},
 	}
 )
 
@@ -35,73 +27,164 @@ type csrf struct {
 	// csrf location : Header|Form
 	From string
 	// csrf name
-	Name              string
-	Cookie            http.Cookie
-	Secret            string
+	Name string
+	// Field and Header are the names of the token in form(csrfField) and
+	// header(csrfMeta), default is Name
+	Field, Header string
+	// Extractor finds the token of a request, default is ChainExtractor of
+	// HeaderExtractor(Header) and FormExtractor(Field)
+	Extractor TokenExtractor
+	Cookie    http.Cookie
+	// Secret is the key "0" when Keys is empty
+	Secret string
+	// FailFunc handles the rejected requests, default is DefaultFailFunc
+	FailFunc func(ctx *water.Context, r Reason)
+	// ErrorFunc and NoFunc(ReasonMissing) are used without FailFunc for
+	// compatibility, the reason is got by GetReason
 	ErrorFunc, NoFunc func(*water.Context)
+
+	// Keys sign and validate tokens, the first one signs and all are accepted,
+	// so a new key is put first while rotating
+	Keys []Key
+	// TTL is the lifetime of token, default is 24 hours
+	TTL time.Duration
+	// ClockSkew accepts the tokens issued in the future by a machine whose clock
+	// is ahead, default is 1 minute
+	ClockSkew time.Duration
+	// Claims returns the values bound to token besides session or client id, e.g. user id
+	Claims func(ctx *water.Context) []string
+	// ClientCookie keeps a signed random client id tokens are bound to when
+	// the session middleware isn't used, default is Cookie.Name + "_client"
+	ClientCookie string
+
+	// TrustedOrigins are the origins allowed besides the request's host,
+	// e.g. "https://www.example.com"
+	TrustedOrigins []string
+	// RequireOrigin rejects the unsafe requests without Origin and Referer
+	RequireOrigin bool
+	// SkipOriginCheck disables the Origin/Referer and Sec-Fetch-Site checks
+	SkipOriginCheck bool
+	// ProxyHeader gives the scheme of the request behind a trusted proxy
+	// terminating TLS, e.g. "X-Forwarded-Proto", it's compared with the scheme
+	// of Origin and Referer. Don't set it without such a proxy, clients can
+	// send it
+	ProxyHeader string
+
+	// IgnoreMethods are the safe methods generating token instead of validating,
+	// default is GET, HEAD, OPTIONS and TRACE
+	IgnoreMethods []string
+	// SkipPaths are path.Match patterns bypassing the middleware, a pattern ending
+	// with "**" matches the prefix, e.g. "/webhook/**", and a pattern may start
+	// with the method it's limited to, e.g. "POST /upload"
+	SkipPaths []string
+	// SkipHeaders bypasses the requests carrying one of the headers, e.g.
+	// "X-Api-Key" of the token authenticated api. Don't use a header sent by
+	// browsers automatically, e.g. "Authorization" of basic auth
+	SkipHeaders []string
+	// OnSkip is called with the reason of a bypassed request, it's logged by default
+	OnSkip func(ctx *water.Context, reason string)
+
+	origins map[string]bool
 }
 
 func (c *csrf) Validate(ctx *water.Context) {
-	token := ""
+	if exempted(ctx) {
+		if c.OnSkip != nil {
+			c.OnSkip(ctx, "exempt")
+		}
+		return
+	}
 
-	switch c.From {
-	case "Form":
-		token = ctx.Req.FormValue(c.Name)
-	default:
-		token = ctx.Req.Header.Get(c.Name)
+	if !c.SkipOriginCheck {
+		if r := c.checkOrigin(ctx); r != "" {
+			c.fail(ctx, r)
+			return
+		}
 	}
 
+	token := c.extractor().Extract(ctx)
 	if token == "" {
-		c.ErrorFunc(ctx)
+		c.fail(ctx, ReasonMissing)
 		return
 	}
 
-	if ctx.Cookie(c.Cookie.Name) == token {
+	// the header clients send the token of cookie, the form sends a masked one
+	cookie := ctx.Cookie(c.Cookie.Name)
+	if cookie == token {
+		return
+	}
+	token = csrfutil.Unmask(token)
+	if cookie == token {
 		return
 	}
 
 	// delete old token
 	ctx.SetCookie(c.Cookie.Name, "", -1, c.Cookie.Path, c.Cookie.Domain)
-	if !c.ValidateToken(token, session.Get(ctx).Id) {
-		c.ErrorFunc(ctx)
+	if r := c.checkToken(token, ctx.Req.URL.Path, c.id(ctx), c.claims(ctx)); r != "" {
+		c.fail(ctx, r)
 	}
 }
 
-func (c *csrf) ValidateToken(token, id string) bool {
-	return validToken(token, c.Secret, id)
+func (c *csrf) extractor() TokenExtractor {
+	if c.Extractor != nil {
+		return c.Extractor
+	}
+	// both helpers of FuncMap are accepted
+	return ChainExtractor{HeaderExtractor(c.header()), FormExtractor(c.field())}
+}
+
+func (c *csrf) field() string {
+	if c.Field != "" {
+		return c.Field
+	}
+	return c.Name
+}
+
+func (c *csrf) header() string {
+	if c.Header != "" {
+		return c.Header
+	}
+	return c.Name
 }
 
 func (c *csrf) Generate(ctx *water.Context) {
 	token := ctx.Cookie(c.Cookie.Name)
 	if token == "" {
-		token = c.GenerateToken(session.Get(ctx).Id)
-		ctx.SetCookie(c.Cookie.Name, token, int(TIMEOUT/time.Second), c.Cookie.Path, c.Cookie.Domain, false, true)
+		token = c.GenerateToken(c.id(ctx), c.claims(ctx)...)
+		ctx.SetCookie(c.Cookie.Name, token, int(c.TTL/time.Second), c.Cookie.Path, c.Cookie.Domain, false, true)
 	}
 
 	if c.From == "Header" {
-		ctx.ResponseWriter.Header().Add(c.Name, token)
-	} else {
-		ctx.Environ.Set("CSRF", token)
+		ctx.ResponseWriter.Header().Add(c.header(), token)
 	}
-}
-
-func (c *csrf) GenerateToken(id string) string {
-	return generateToken(c.Secret, id, time.Now())
+	// rendered in pages, so it's masked
+	ctx.Environ.Set("CSRF", csrfutil.Mask(token))
 }
 
 func New(o *csrf) water.HandlerFunc {
 	if o == nil {
 		panic("csrf2 : csrf need option")
 	}
-	if len(o.Secret) < 16 {
-		panic("csrf2 : csrf need len(secret) >= 16")
-	}
 	if o.Cookie.Name == "" || o.Cookie.Path == "" {
 		panic("csrf2 : csrf need templateCookie")
 	}
+	if o.ClientCookie == "" {
+		o.ClientCookie = o.Cookie.Name + "_client"
+	}
+	if o.ClientCookie == o.Cookie.Name {
+		panic("csrf2 : ClientCookie must differ from Cookie.Name")
+	}
+	o.initKeys()
+	o.initOrigins()
+	o.initSkip()
 
 	return func(ctx *water.Context) {
-		if goutil.InSlice(ctx.Req.Method, ignoreMethods) {
+		if reason := o.skip(ctx); reason != "" {
+			o.OnSkip(ctx, reason)
+			return
+		}
+
+		if goutil.InSlice(ctx.Req.Method, o.IgnoreMethods) {
 			o.Generate(ctx)
 		} else {
 			o.Validate(ctx)
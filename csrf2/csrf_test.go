@@ -3,17 +3,23 @@
 package csrf
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
-	"log"
+	"html/template"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/internal/csrfutil"
 	"github.com/meilihao/water-contrib/session"
-	"github.com/meilihao/water-contrib/session/ssdb"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -22,21 +28,7 @@ var o *csrf
 
 func init() {
 	// first,init session
-	sessionStore, err := ssdbstore.New(`
-{
-    "SSDB":{
-        "Host":"127.0.0.1",
-        "Port":8888,
-        "MinPoolSize":5,
-        "MaxPoolSize":50,
-        "AcquireIncrement":5
-    },
-    "Prefix":"sssdb_",
-    "MaxAge":0
-}`)
-	if err != nil {
-		log.Fatalln("init session store err: ", err)
-	}
+	sessionStore := session.NewMemoryStore(0)
 
 	manager := new(session.Options)
 	manager.Generator = session.NewSha1Generator("test")
@@ -185,12 +177,21 @@ func Test_TokenChange(t *testing.T) {
 }
 
 func Test_ValidateTimeout(t *testing.T) {
-	// change const -> var
-	TIMEOUT = 3 * time.Second
+	c := &csrf{
+		From:   "Header",
+		Name:   "X-CSRF",
+		Secret: o.Secret,
+		Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+		TTL:    time.Second,
+		ErrorFunc: func(ctx *water.Context) {
+			ctx.Forbidden()
+		},
+	}
+
 	Convey("Validate token timeout", t, func() {
 		w := water.NewRouter()
 		w.Before(session.New(sessionManager))
-		w.Before(New(o))
+		w.Before(New(c))
 
 		w.Get("/test1-1", func(ctx *water.Context) {
 		})
@@ -203,20 +204,726 @@ func Test_ValidateTimeout(t *testing.T) {
 		w.ServeHTTP(resp, req)
 
 		session := getCookieSession(resp.Header())
-		token := resp.Header().Get(o.Name)
-		time.Sleep(5 * time.Second)
+		token := resp.Header().Get(c.Name)
+		time.Sleep(2 * time.Second)
 
 		resp = httptest.NewRecorder()
 		req, err = http.NewRequest("POST", "/test1-2", nil)
 		So(err, ShouldBeNil)
 		req.Header.Set("Cookie", "_csrf=123456;")
 		req.Header.Set("Cookie", session)
-		req.Header.Set(o.Name, token)
+		req.Header.Set(c.Name, token)
 		w.ServeHTTP(resp, req)
 		So(resp.Code, ShouldEqual, 403)
 	})
 }
 
+func Test_Token(t *testing.T) {
+	Convey("Token format, keys and claims", t, func() {
+		c := &csrf{
+			Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+			Keys:   []Key{{Id: "old", Secret: "old-secret-123456789"}},
+		}
+		New(c)
+		So(c.TTL, ShouldEqual, 24*time.Hour)
+		So(c.ClockSkew, ShouldEqual, time.Minute)
+
+		token := c.GenerateToken("sid", "user1")
+		So(c.ValidateToken(token, "sid", "user1"), ShouldBeTrue)
+		So(c.ValidateToken(token, "sid2", "user1"), ShouldBeFalse)
+		So(c.ValidateToken(token, "sid", "user2"), ShouldBeFalse)
+		So(c.ValidateToken(token, "sid"), ShouldBeFalse)
+		So(c.ValidateToken(token+"x", "sid", "user1"), ShouldBeFalse)
+		So(c.ValidateToken("bad", "sid", "user1"), ShouldBeFalse)
+
+		// rotate: the new key signs, the old one is still valid
+		c.Keys = append([]Key{{Id: "new", Secret: "new-secret-123456789"}}, c.Keys...)
+		So(c.ValidateToken(token, "sid", "user1"), ShouldBeTrue)
+		newToken := c.GenerateToken("sid")
+		So(c.ValidateToken(newToken, "sid"), ShouldBeTrue)
+		c.Keys = c.Keys[:1]
+		So(c.ValidateToken(token, "sid", "user1"), ShouldBeFalse)
+		So(c.ValidateToken(newToken, "sid"), ShouldBeTrue)
+
+		// action
+		token = c.generateToken("/form", "sid", nil, time.Now())
+		So(c.validToken(token, "/form", "sid", nil), ShouldBeTrue)
+		So(c.validToken(token, "/other", "sid", nil), ShouldBeFalse)
+		So(c.ValidateToken(token, "sid"), ShouldBeFalse)
+
+		// ttl and clock skew
+		token = c.generateToken("", "sid", nil, time.Now().Add(-25*time.Hour))
+		So(c.ValidateToken(token, "sid"), ShouldBeFalse)
+		token = c.generateToken("", "sid", nil, time.Now().Add(30*time.Second))
+		So(c.ValidateToken(token, "sid"), ShouldBeTrue)
+		token = c.generateToken("", "sid", nil, time.Now().Add(2*time.Minute))
+		So(c.ValidateToken(token, "sid"), ShouldBeFalse)
+	})
+
+	Convey("Invalid keys", t, func() {
+		newCsrf := func(keys ...Key) func() {
+			return func() {
+				New(&csrf{
+					Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+					Keys:   keys,
+				})
+			}
+		}
+		So(newCsrf(), ShouldPanic)
+		So(newCsrf(Key{Id: "a", Secret: "short"}), ShouldPanic)
+		So(newCsrf(Key{Id: "a|b", Secret: "1234567890123456"}), ShouldPanic)
+		So(newCsrf(Key{Id: "a", Secret: "1234567890123456"}, Key{Id: "a", Secret: "6543210987654321"}), ShouldPanic)
+		So(newCsrf(Key{Id: "a", Secret: "1234567890123456"}), ShouldNotPanic)
+	})
+}
+
+func Test_Mask(t *testing.T) {
+	Convey("Masked token of Form", t, func() {
+		c := &csrf{
+			From:   "Form",
+			Name:   "_csrf",
+			Secret: o.Secret,
+			Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+			ErrorFunc: func(ctx *water.Context) {
+				ctx.Forbidden()
+			},
+		}
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Before(New(c))
+
+		token := ""
+		w.Get("/test1-1", func(ctx *water.Context) {
+			token = ctx.Environ.GetString("CSRF")
+		})
+		w.Post("/test1-2", func(ctx *water.Context) {
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/test1-1", nil)
+		So(err, ShouldBeNil)
+		w.ServeHTTP(resp, req)
+		cookie := getCookieCSRF(resp.Header())
+		raw := strings.TrimPrefix(strings.SplitN(cookie, ";", 2)[0], "_csrf=")
+		first := token
+
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", "/test1-1", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		w.ServeHTTP(resp, req)
+		So(token, ShouldNotEqual, first)
+		So(token, ShouldNotContainSubstring, raw)
+		So(csrfutil.Unmask(token), ShouldEqual, raw)
+		So(csrfutil.Unmask(first), ShouldEqual, raw)
+
+		post := func(v string) int {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/test1-2?_csrf="+v, nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Cookie", cookie)
+			w.ServeHTTP(resp, req)
+			return resp.Code
+		}
+		So(post(first), ShouldEqual, 200)
+		So(post(token), ShouldEqual, 200)
+		// unmasked token of old pages
+		So(post(raw), ShouldEqual, 200)
+		So(post(csrfutil.Mask(raw)[1:]), ShouldEqual, 403)
+	})
+}
+
+func Test_FuncMap(t *testing.T) {
+	Convey("Render masked token by template helpers", t, func() {
+		c := &csrf{
+			From:   "Header",
+			Name:   "X-CSRF",
+			Field:  "csrf_token",
+			Secret: o.Secret,
+			Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+			ErrorFunc: func(ctx *water.Context) {
+				ctx.Forbidden()
+			},
+		}
+		tpl := template.Must(template.New("page").Funcs(c.FuncMap()).Parse(
+			`{{csrfMeta .}}{{csrfScript}}<form>{{csrfField .}}</form>`))
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Before(New(c))
+
+		page := ""
+		w.Get("/test1-1", func(ctx *water.Context) {
+			var buf bytes.Buffer
+			So(tpl.Execute(&buf, ctx.Environ.GetString("CSRF")), ShouldBeNil)
+			page = buf.String()
+		})
+		w.Post("/test1-2", func(ctx *water.Context) {
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/test1-1", nil)
+		So(err, ShouldBeNil)
+		w.ServeHTTP(resp, req)
+		cookie := getCookieCSRF(resp.Header())
+
+		So(page, ShouldContainSubstring, `<meta name="csrf-header" content="X-CSRF">`)
+		So(page, ShouldContainSubstring, "XMLHttpRequest")
+		meta := regexp.MustCompile(`name="csrf-token" content="([^"]+)"`).FindStringSubmatch(page)
+		field := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(page)
+		So(meta, ShouldHaveLength, 2)
+		So(field, ShouldHaveLength, 2)
+		So(meta[1], ShouldNotEqual, field[1])
+
+		// the script sends the token of meta by header
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("POST", "/test1-2", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set(c.Name, meta[1])
+		w.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 200)
+
+		// the form posts the token of csrfField
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("POST", "/test1-2", strings.NewReader("csrf_token="+field[1]))
+		So(err, ShouldBeNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", cookie)
+		w.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 200)
+
+		// the field isn't read from the header
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("POST", "/test1-2", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("csrf_token", field[1])
+		w.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 403)
+	})
+}
+
+func Test_Fail(t *testing.T) {
+	Convey("Failure reasons", t, func() {
+		var reason Reason
+		c := &csrf{
+			From:   "Header",
+			Name:   "X-CSRF",
+			Secret: o.Secret,
+			Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+			FailFunc: func(ctx *water.Context, r Reason) {
+				reason = r
+				ctx.Forbidden()
+			},
+		}
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Before(New(c))
+		w.Post("/test1-2", func(ctx *water.Context) {
+		})
+
+		post := func(token string) int {
+			reason = ""
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/test1-2", nil)
+			So(err, ShouldBeNil)
+			if token != "" {
+				req.Header.Set(c.Name, token)
+			}
+			w.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		So(post(""), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonMissing)
+		So(post("123456"), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonMalformed)
+		So(post(c.generateToken("", "sid", nil, time.Now().Add(-25*time.Hour))), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonExpired)
+		So(post(c.GenerateToken("sid")), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonMismatch)
+	})
+
+	Convey("NoFunc handles missing token without FailFunc", t, func() {
+		no, bad := 0, 0
+		c := &csrf{
+			From:      "Header",
+			Name:      "X-CSRF",
+			Secret:    o.Secret,
+			Cookie:    http.Cookie{Name: "_csrf", Path: "/"},
+			NoFunc:    func(ctx *water.Context) { no++; ctx.Forbidden() },
+			ErrorFunc: func(ctx *water.Context) { bad++; ctx.Forbidden() },
+		}
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Before(New(c))
+		w.Post("/test1-2", func(ctx *water.Context) {
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/test1-2", nil)
+		So(err, ShouldBeNil)
+		w.ServeHTTP(resp, req)
+		So(no, ShouldEqual, 1)
+		So(bad, ShouldEqual, 0)
+
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("POST", "/test1-2", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set(c.Name, "123456")
+		w.ServeHTTP(resp, req)
+		So(no, ShouldEqual, 1)
+		So(bad, ShouldEqual, 1)
+	})
+
+	Convey("DefaultFailFunc negotiates by Accept", t, func() {
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Before(New(o))
+		w.Post("/test1-2", func(ctx *water.Context) {
+		})
+
+		respond := func(accept string) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/test1-2", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Accept", accept)
+			req.Header.Set(o.Name, "123456")
+			w.ServeHTTP(resp, req)
+			So(resp.Code, ShouldEqual, 403)
+			return resp
+		}
+
+		resp := respond("application/json, text/plain, */*")
+		So(resp.Header().Get("Content-Type"), ShouldEqual, "application/problem+json")
+		var p problem
+		So(json.Unmarshal(resp.Body.Bytes(), &p), ShouldBeNil)
+		So(p.Status, ShouldEqual, 403)
+		So(p.Reason, ShouldEqual, ReasonMalformed)
+		So(p.Detail, ShouldEqual, ReasonMalformed.Detail())
+
+		resp = respond("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+		So(resp.Header().Get("Content-Type"), ShouldStartWith, "text/html")
+		So(resp.Body.String(), ShouldContainSubstring, ReasonMalformed.Detail())
+
+		resp = respond("*/*")
+		So(resp.Header().Get("Content-Type"), ShouldStartWith, "text/plain")
+		So(resp.Body.String(), ShouldEqual, "csrf : malformed")
+	})
+
+	Convey("negotiate", t, func() {
+		offers := []string{"text/plain", "application/json", "text/html"}
+		So(negotiate("", offers...), ShouldEqual, "text/plain")
+		So(negotiate("application/json", offers...), ShouldEqual, "application/json")
+		So(negotiate("text/html;q=0.5, application/json;q=0.8", offers...), ShouldEqual, "application/json")
+		So(negotiate("text/*;q=0.9, application/json;q=0", offers...), ShouldEqual, "text/plain")
+		So(negotiate("image/png", offers...), ShouldEqual, "text/plain")
+		// a tie is won by the order of accept, not of offers
+		So(negotiate("text/html, application/json", offers...), ShouldEqual, "text/html")
+		So(negotiate("application/json, text/html", offers...), ShouldEqual, "application/json")
+		So(negotiate("text/html;q=0.8, application/json;q=0.8", offers...), ShouldEqual, "text/html")
+		So(negotiate("*/*", offers...), ShouldEqual, "text/plain")
+	})
+}
+
+func Test_Stateless(t *testing.T) {
+	Convey("Bind token to client id without session", t, func() {
+		var reason Reason
+		c := &csrf{
+			From:   "Header",
+			Name:   "X-CSRF",
+			Secret: o.Secret,
+			Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+			FailFunc: func(ctx *water.Context, r Reason) {
+				reason = r
+				ctx.Forbidden()
+			},
+		}
+
+		w := water.NewRouter()
+		w.Before(New(c))
+		w.Get("/test1-1", func(ctx *water.Context) {
+		})
+		w.Post("/test1-2", func(ctx *water.Context) {
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/test1-1", nil)
+		So(err, ShouldBeNil)
+		w.ServeHTTP(resp, req)
+		token := resp.Header().Get(c.Name)
+		var client string
+		for _, v := range resp.Header()["Set-Cookie"] {
+			if strings.HasPrefix(v, c.ClientCookie+"=") {
+				client = strings.SplitN(v, ";", 2)[0]
+			}
+		}
+		So(c.ClientCookie, ShouldEqual, "_csrf_client")
+		So(client, ShouldNotBeEmpty)
+		So(token, ShouldNotBeEmpty)
+
+		post := func(cookie string) int {
+			reason = ""
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/test1-2", nil)
+			So(err, ShouldBeNil)
+			if cookie != "" {
+				req.Header.Set("Cookie", cookie)
+			}
+			req.Header.Set(c.Name, token)
+			w.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		So(post(client), ShouldEqual, 200)
+		So(post(""), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonMismatch)
+
+		// forged client id
+		id := strings.TrimPrefix(client, c.ClientCookie+"=")
+		So(c.validClientId(id), ShouldBeTrue)
+		So(c.validClientId(id[1:]), ShouldBeFalse)
+		So(post(c.ClientCookie+"="+id[:strings.IndexByte(id, '.')]+".forged"), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonMismatch)
+	})
+}
+
+func Test_Extractor(t *testing.T) {
+	Convey("Extract token from header, json and multipart body", t, func() {
+		c := &csrf{
+			Name:   "X-CSRF",
+			Secret: o.Secret,
+			Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+			Extractor: ChainExtractor{
+				HeaderExtractor("X-CSRF"),
+				&JSONExtractor{Field: "csrf"},
+				&MultipartExtractor{Name: "csrf"},
+			},
+			FailFunc: func(ctx *water.Context, r Reason) {
+				ctx.Forbidden()
+			},
+		}
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Before(New(c))
+
+		token := ""
+		w.Get("/test1-1", func(ctx *water.Context) {
+			token = ctx.Environ.GetString("CSRF")
+		})
+		body := ""
+		w.Post("/json", func(ctx *water.Context) {
+			bs, err := ioutil.ReadAll(ctx.Req.Body)
+			So(err, ShouldBeNil)
+			body = string(bs)
+		})
+		w.Post("/upload", func(ctx *water.Context) {
+			So(ctx.Req.ParseMultipartForm(1<<20), ShouldBeNil)
+			f, _, err := ctx.Req.FormFile("file")
+			So(err, ShouldBeNil)
+			bs, err := ioutil.ReadAll(f)
+			So(err, ShouldBeNil)
+			body = ctx.Req.FormValue("csrf") + ":" + string(bs)
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/test1-1", nil)
+		So(err, ShouldBeNil)
+		w.ServeHTTP(resp, req)
+		cookie := getCookieCSRF(resp.Header())
+
+		post := func(url, contentType, data string) int {
+			body = ""
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", url, strings.NewReader(data))
+			So(err, ShouldBeNil)
+			req.Header.Set("Cookie", cookie)
+			req.Header.Set("Content-Type", contentType)
+			w.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		data := fmt.Sprintf(`{"csrf":%q,"name":"chen"}`, token)
+		So(post("/json", "application/json; charset=utf-8", data), ShouldEqual, 200)
+		So(body, ShouldEqual, data)
+		So(post("/json", "application/json", `{"name":"chen"}`), ShouldEqual, 403)
+		So(post("/json", "application/json", `{"csrf":1}`), ShouldEqual, 403)
+
+		multipartBody := func(first string) (string, string) {
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+			if first == "csrf" {
+				mw.WriteField("csrf", token)
+			}
+			fw, err := mw.CreateFormFile("file", "a.txt")
+			So(err, ShouldBeNil)
+			fw.Write(bytes.Repeat([]byte("a"), 100))
+			if first != "csrf" {
+				mw.WriteField("csrf", token)
+			}
+			mw.Close()
+			return mw.FormDataContentType(), buf.String()
+		}
+
+		contentType, data := multipartBody("csrf")
+		So(post("/upload", contentType, data), ShouldEqual, 200)
+		So(body, ShouldEqual, token+":"+strings.Repeat("a", 100))
+		// the token isn't the first part
+		contentType, data = multipartBody("file")
+		So(post("/upload", contentType, data), ShouldEqual, 403)
+	})
+}
+
+func Test_Origin(t *testing.T) {
+	Convey("Validate Origin, Referer and Sec-Fetch-Site", t, func() {
+		var reason Reason
+		c := &csrf{
+			From:   "Header",
+			Name:   "X-CSRF",
+			Secret: o.Secret,
+			Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+			ErrorFunc: func(ctx *water.Context) {
+				reason = GetReason(ctx)
+				ctx.Forbidden()
+			},
+			TrustedOrigins: []string{"https://app.test.com"},
+		}
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Before(New(c))
+
+		w.Get("/test1-1", func(ctx *water.Context) {
+		})
+		w.Post("/test1-2", func(ctx *water.Context) {
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/test1-1", nil)
+		So(err, ShouldBeNil)
+		w.ServeHTTP(resp, req)
+		cookie := getCookieCSRF(resp.Header())
+		token := resp.Header().Get(c.Name)
+
+		post := func(header map[string]string) int {
+			reason = ""
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "http://www.test.com/test1-2", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Cookie", cookie)
+			req.Header.Set(c.Name, token)
+			for k, v := range header {
+				req.Header.Set(k, v)
+			}
+			w.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		So(post(nil), ShouldEqual, 200)
+		So(post(map[string]string{"Origin": "http://www.test.com"}), ShouldEqual, 200)
+		So(post(map[string]string{"Origin": "https://app.test.com", "Sec-Fetch-Site": "cross-site"}), ShouldEqual, 200)
+		So(post(map[string]string{"Referer": "http://www.test.com/form"}), ShouldEqual, 200)
+
+		So(post(map[string]string{"Origin": "http://evil.com"}), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonOrigin)
+		So(post(map[string]string{"Origin": "null"}), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonOrigin)
+		// Origin is preferred
+		So(post(map[string]string{"Origin": "http://evil.com", "Referer": "http://www.test.com/form"}), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonOrigin)
+		So(post(map[string]string{"Referer": "http://evil.com/form"}), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonReferer)
+		So(post(map[string]string{"Sec-Fetch-Site": "cross-site"}), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonCrossSite)
+
+		// the scheme and port are compared too
+		So(post(map[string]string{"Origin": "https://www.test.com"}), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonOrigin)
+		So(post(map[string]string{"Origin": "http://www.test.com:8080"}), ShouldEqual, 403)
+		So(post(map[string]string{"Origin": "http://WWW.test.com:80"}), ShouldEqual, 200)
+		So(post(map[string]string{"Referer": "https://www.test.com/form"}), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonReferer)
+		// the proxy header is trusted only if it's set
+		So(post(map[string]string{"Origin": "https://www.test.com", "X-Forwarded-Proto": "https"}), ShouldEqual, 403)
+		c.ProxyHeader = "X-Forwarded-Proto"
+		So(post(map[string]string{"Origin": "https://www.test.com", "X-Forwarded-Proto": "https"}), ShouldEqual, 200)
+		So(post(map[string]string{"Origin": "http://www.test.com", "X-Forwarded-Proto": "https, http"}), ShouldEqual, 403)
+		So(post(map[string]string{"Origin": "http://www.test.com"}), ShouldEqual, 200)
+		c.ProxyHeader = ""
+
+		c.RequireOrigin = true
+		So(post(nil), ShouldEqual, 403)
+		So(reason, ShouldEqual, ReasonNoOrigin)
+		So(post(map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://www.test.com"}), ShouldEqual, 200)
+	})
+
+	Convey("Origin of a TLS request", t, func() {
+		var reason Reason
+		c := &csrf{
+			From:   "Header",
+			Name:   "X-CSRF",
+			Secret: o.Secret,
+			Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+			FailFunc: func(ctx *water.Context, r Reason) {
+				reason = r
+				ctx.Forbidden()
+			},
+		}
+
+		w := water.NewRouter()
+		w.Before(New(c))
+		w.Post("/test1-2", func(ctx *water.Context) {
+		})
+
+		// the token is missing after the origin check passes
+		post := func(o string) Reason {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "https://www.test.com/test1-2", nil)
+			So(err, ShouldBeNil)
+			req.TLS = &tls.ConnectionState{}
+			req.Header.Set("Origin", o)
+			w.ServeHTTP(resp, req)
+			So(resp.Code, ShouldEqual, 403)
+			return reason
+		}
+		So(post("https://www.test.com"), ShouldEqual, ReasonMissing)
+		So(post("https://www.test.com:443"), ShouldEqual, ReasonMissing)
+		So(post("http://www.test.com"), ShouldEqual, ReasonOrigin)
+	})
+
+	Convey("Invalid trusted origin", t, func() {
+		So(func() {
+			New(&csrf{
+				Secret:         o.Secret,
+				Cookie:         http.Cookie{Name: "_csrf", Path: "/"},
+				TrustedOrigins: []string{"app.test.com/path"},
+			})
+		}, ShouldPanic)
+	})
+}
+
+func Test_Skip(t *testing.T) {
+	Convey("Skip paths and headers", t, func() {
+		var reasons []string
+		c := &csrf{
+			From:      "Header",
+			Name:      "X-CSRF",
+			Secret:    o.Secret,
+			Cookie:    http.Cookie{Name: "_csrf", Path: "/"},
+			ErrorFunc: func(ctx *water.Context) { ctx.Forbidden() },
+			OnSkip: func(ctx *water.Context, reason string) {
+				reasons = append(reasons, reason)
+			},
+			IgnoreMethods: []string{"get"},
+			SkipPaths:     []string{"/webhook/**", "/hooks/*/ping", "post /upload"},
+			SkipHeaders:   []string{"X-Api-Key"},
+		}
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		w.Before(New(c))
+
+		h := func(ctx *water.Context) {}
+		w.Post("/webhook/github", h)
+		w.Post("/hooks/a/ping", h)
+		w.Post("/upload", h)
+		w.Put("/upload", h)
+		w.Post("/api", h)
+		w.Get("/page", h)
+
+		code := func(method, url string, header map[string]string) int {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(method, url, nil)
+			So(err, ShouldBeNil)
+			for k, v := range header {
+				req.Header.Set(k, v)
+			}
+			w.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		So(code("POST", "/webhook/github", nil), ShouldEqual, 200)
+		So(code("POST", "/hooks/a/ping", nil), ShouldEqual, 200)
+		So(code("POST", "/upload", nil), ShouldEqual, 200)
+		So(code("POST", "/api", map[string]string{"X-Api-Key": "key"}), ShouldEqual, 200)
+		So(reasons, ShouldResemble, []string{"path /webhook/**", "path /hooks/*/ping", "path post /upload", "header X-Api-Key"})
+
+		So(code("PUT", "/upload", nil), ShouldEqual, 403)
+		So(code("POST", "/api", nil), ShouldEqual, 403)
+		So(code("GET", "/page", nil), ShouldEqual, 200)
+		So(len(reasons), ShouldEqual, 4)
+	})
+
+	Convey("IgnoreMethods is normalized in a copy", t, func() {
+		methods := []string{"get"}
+		c := &csrf{
+			Secret:        o.Secret,
+			Cookie:        http.Cookie{Name: "_csrf", Path: "/"},
+			IgnoreMethods: methods,
+		}
+		New(c)
+		So(c.IgnoreMethods, ShouldResemble, []string{"GET"})
+		So(methods, ShouldResemble, []string{"get"})
+
+		c = &csrf{
+			Secret: o.Secret,
+			Cookie: http.Cookie{Name: "_csrf", Path: "/"},
+		}
+		New(c)
+		c.IgnoreMethods[0] = "POST"
+		So(ignoreMethods[0], ShouldEqual, "GET")
+	})
+
+	Convey("Exempt route", t, func() {
+		var reasons []string
+		c := &csrf{
+			From:      "Header",
+			Name:      "X-CSRF",
+			Secret:    o.Secret,
+			Cookie:    http.Cookie{Name: "_csrf", Path: "/"},
+			ErrorFunc: func(ctx *water.Context) { ctx.Forbidden() },
+			OnSkip: func(ctx *water.Context, reason string) {
+				reasons = append(reasons, reason)
+			},
+		}
+
+		w := water.NewRouter()
+		w.Before(session.New(sessionManager))
+		protect := New(c)
+
+		h := func(ctx *water.Context) {}
+		w.Post("/form", protect, h)
+		w.Post("/webhook", Exempt, protect, h)
+
+		code := func(url string) int {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", url, nil)
+			So(err, ShouldBeNil)
+			w.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		So(code("/form"), ShouldEqual, 403)
+		So(code("/webhook"), ShouldEqual, 200)
+		So(reasons, ShouldResemble, []string{"exempt"})
+	})
+
+	Convey("Cookie can't be skipped", t, func() {
+		So(func() {
+			New(&csrf{
+				Secret:      o.Secret,
+				Cookie:      http.Cookie{Name: "_csrf", Path: "/"},
+				SkipHeaders: []string{"cookie"},
+			})
+		}, ShouldPanic)
+	})
+}
+
 func getCookieCSRF(h http.Header) string {
 	s := h["Set-Cookie"]
 	for _, v := range s {
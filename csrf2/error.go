@@ -0,0 +1,170 @@
+// Copyright 2016 The Water Authors
+
+package csrf
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/meilihao/water"
+)
+
+// Reason is why a request is rejected.
+type Reason string
+
+const (
+	// ReasonMissing means the request has no token
+	ReasonMissing Reason = "missing"
+	// ReasonMalformed means the token can't be decoded
+	ReasonMalformed Reason = "malformed"
+	// ReasonExpired means the token is older than TTL, or from the future
+	ReasonExpired Reason = "expired"
+	// ReasonMismatch means the token isn't signed for the request, e.g. another
+	// session, claims, action or a removed key
+	ReasonMismatch Reason = "mismatch"
+	// ReasonCrossSite means Sec-Fetch-Site is cross-site
+	ReasonCrossSite Reason = "cross-site"
+	// ReasonOrigin means Origin isn't trusted
+	ReasonOrigin Reason = "origin"
+	// ReasonReferer means Referer isn't trusted
+	ReasonReferer Reason = "referer"
+	// ReasonNoOrigin means the request has no Origin and Referer in RequireOrigin
+	ReasonNoOrigin Reason = "no-origin"
+)
+
+var reasonDetails = map[Reason]string{
+	ReasonMissing:   "The request has no CSRF token.",
+	ReasonMalformed: "The CSRF token is malformed.",
+	ReasonExpired:   "The CSRF token is expired, please reload the page.",
+	ReasonMismatch:  "The CSRF token doesn't match the session.",
+	ReasonCrossSite: "Cross-site requests are not allowed.",
+	ReasonOrigin:    "The origin of the request is not trusted.",
+	ReasonReferer:   "The referer of the request is not trusted.",
+	ReasonNoOrigin:  "The request has no origin or referer.",
+}
+
+// Detail returns a human readable description of r.
+func (r Reason) Detail() string {
+	if d, ok := reasonDetails[r]; ok {
+		return d
+	}
+	return "CSRF validation failed."
+}
+
+// GetReason returns why the request is rejected, it's empty if not.
+func GetReason(ctx *water.Context) Reason {
+	r, _ := ctx.Environ.Get("CSRFReason").(Reason)
+	return r
+}
+
+// fail handles a rejected request by FailFunc, or by NoFunc and ErrorFunc
+// which are kept for compatibility.
+func (c *csrf) fail(ctx *water.Context, r Reason) {
+	ctx.Environ.Set("CSRFReason", r)
+
+	switch {
+	case c.FailFunc != nil:
+		c.FailFunc(ctx, r)
+	case r == ReasonMissing && c.NoFunc != nil:
+		c.NoFunc(ctx)
+	case c.ErrorFunc != nil:
+		c.ErrorFunc(ctx)
+	default:
+		DefaultFailFunc(ctx, r)
+	}
+}
+
+// problem is a RFC 7807 problem details.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Reason Reason `json:"reason"`
+}
+
+var htmlError = template.Must(template.New("csrf").Parse(`<!DOCTYPE html>
+<html>
+<head><title>403 Forbidden</title></head>
+<body>
+<h1>CSRF validation failed</h1>
+<p>{{.Detail}}</p>
+</body>
+</html>
+`))
+
+// DefaultFailFunc responds 403 with problem details in json, html or plain
+// text by the Accept of the request.
+func DefaultFailFunc(ctx *water.Context, r Reason) {
+	h := ctx.ResponseWriter.Header()
+	h.Add("Vary", "Accept")
+
+	switch negotiate(ctx.Req.Header.Get("Accept"), "text/plain", "application/json", "application/problem+json", "text/html") {
+	case "application/json", "application/problem+json":
+		h.Set("Content-Type", "application/problem+json")
+		ctx.ResponseWriter.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(ctx.ResponseWriter).Encode(&problem{
+			Type:   "about:blank",
+			Title:  "CSRF validation failed",
+			Status: http.StatusForbidden,
+			Detail: r.Detail(),
+			Reason: r,
+		})
+	case "text/html":
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		ctx.ResponseWriter.WriteHeader(http.StatusForbidden)
+		htmlError.Execute(ctx.ResponseWriter, &problem{Detail: r.Detail()})
+	default:
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		ctx.ResponseWriter.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(ctx.ResponseWriter, "csrf : %s", r)
+	}
+}
+
+// negotiate returns the offer of the highest quality in accept. A tie is won
+// by the first media type of accept, a wildcard is given the first offer it
+// matches, and the first offer is the default.
+func negotiate(accept string, offers ...string) string {
+	best, bestQ := offers[0], -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q := part, 1.0
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			mediaType = part[:i]
+			for _, param := range strings.Split(part[i+1:], ";") {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+		}
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if q <= bestQ || q == 0 {
+			continue
+		}
+
+		for _, offer := range offers {
+			if match(mediaType, offer) {
+				best, bestQ = offer, q
+				break
+			}
+		}
+	}
+	return best
+}
+
+func match(mediaType, offer string) bool {
+	switch {
+	case mediaType == "*/*":
+		return true
+	case strings.HasSuffix(mediaType, "/*"):
+		return strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*"))
+	default:
+		return mediaType == offer
+	}
+}
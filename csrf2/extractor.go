@@ -0,0 +1,139 @@
+// Copyright 2016 The Water Authors
+
+package csrf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"github.com/meilihao/water"
+)
+
+var (
+	_ TokenExtractor = HeaderExtractor("")
+	_ TokenExtractor = FormExtractor("")
+	_ TokenExtractor = &MultipartExtractor{}
+	_ TokenExtractor = &JSONExtractor{}
+	_ TokenExtractor = ChainExtractor{}
+)
+
+// TokenExtractor finds the token of a request, it returns "" if not found.
+// An extractor reading the body must restore it for the handlers.
+type TokenExtractor interface {
+	Extract(ctx *water.Context) string
+}
+
+// HeaderExtractor extracts token from the header.
+type HeaderExtractor string
+
+func (e HeaderExtractor) Extract(ctx *water.Context) string {
+	return ctx.Req.Header.Get(string(e))
+}
+
+// FormExtractor extracts token from the form or query, a multipart body is
+// parsed entirely, see MultipartExtractor.
+type FormExtractor string
+
+func (e FormExtractor) Extract(ctx *water.Context) string {
+	return ctx.Req.FormValue(string(e))
+}
+
+// MultipartExtractor extracts token from the first part of a multipart body
+// without parsing the rest, e.g. an upload, so the token field must be the
+// first one of the form.
+type MultipartExtractor struct {
+	Name string
+	// MaxSize limits the read of the token part, default is 4KB
+	MaxSize int64
+}
+
+func (e *MultipartExtractor) Extract(ctx *water.Context) string {
+	mediaType, params, err := mime.ParseMediaType(ctx.Req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" || ctx.Req.Body == nil {
+		return ""
+	}
+	maxSize := e.MaxSize
+	if maxSize <= 0 {
+		maxSize = 4 << 10
+	}
+
+	// the read bytes are put back before the unread body
+	var buf bytes.Buffer
+	defer restoreBody(ctx, &buf)
+
+	r := multipart.NewReader(io.TeeReader(ctx.Req.Body, &buf), params["boundary"])
+	part, err := r.NextPart()
+	if err != nil || part.FormName() != e.Name || part.FileName() != "" {
+		return ""
+	}
+
+	bs, err := ioutil.ReadAll(io.LimitReader(part, maxSize+1))
+	if err != nil || int64(len(bs)) > maxSize {
+		return ""
+	}
+	return strings.TrimSpace(string(bs))
+}
+
+// JSONExtractor extracts token from a top-level string field of a json body.
+type JSONExtractor struct {
+	Field string
+	// MaxSize limits the read of the body, a larger body has no token,
+	// default is 1MB
+	MaxSize int64
+}
+
+func (e *JSONExtractor) Extract(ctx *water.Context) string {
+	mediaType, _, err := mime.ParseMediaType(ctx.Req.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) || ctx.Req.Body == nil {
+		return ""
+	}
+	maxSize := e.MaxSize
+	if maxSize <= 0 {
+		maxSize = 1 << 20
+	}
+
+	var buf bytes.Buffer
+	defer restoreBody(ctx, &buf)
+
+	if _, err = io.Copy(&buf, io.LimitReader(ctx.Req.Body, maxSize+1)); err != nil || int64(buf.Len()) > maxSize {
+		return ""
+	}
+
+	var m map[string]json.RawMessage
+	if err = json.Unmarshal(buf.Bytes(), &m); err != nil {
+		return ""
+	}
+	var token string
+	if err = json.Unmarshal(m[e.Field], &token); err != nil {
+		return ""
+	}
+	return token
+}
+
+// ChainExtractor tries the extractors in order, e.g. a header for ajax and
+// the form for the others.
+type ChainExtractor []TokenExtractor
+
+func (e ChainExtractor) Extract(ctx *water.Context) string {
+	for _, v := range e {
+		if token := v.Extract(ctx); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// restoreBody puts read before the unread body.
+func restoreBody(ctx *water.Context, read *bytes.Buffer) {
+	ctx.Req.Body = readCloser{io.MultiReader(read, ctx.Req.Body), ctx.Req.Body}
+}
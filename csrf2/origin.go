@@ -0,0 +1,96 @@
+// Copyright 2016 The Water Authors
+
+package csrf
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/meilihao/water"
+)
+
+func (c *csrf) initOrigins() {
+	c.origins = make(map[string]bool, len(c.TrustedOrigins))
+	for _, v := range c.TrustedOrigins {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			panic("csrf2 : invalid trusted origin " + v)
+		}
+		c.origins[origin(u)] = true
+	}
+}
+
+// checkOrigin checks the Fetch Metadata and the source of an unsafe request,
+// Referer is used only if Origin is absent.
+func (c *csrf) checkOrigin(ctx *water.Context) Reason {
+	o := ctx.Req.Header.Get("Origin")
+
+	// only the trusted origins may send cross-site requests
+	if ctx.Req.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		if u, err := url.Parse(o); err != nil || !c.origins[origin(u)] {
+			return ReasonCrossSite
+		}
+	}
+
+	if o != "" {
+		if !c.trusted(ctx, o) {
+			return ReasonOrigin
+		}
+		return ""
+	}
+	if referer := ctx.Req.Header.Get("Referer"); referer != "" {
+		if !c.trusted(ctx, referer) {
+			return ReasonReferer
+		}
+		return ""
+	}
+
+	if c.RequireOrigin {
+		return ReasonNoOrigin
+	}
+	return ""
+}
+
+// trusted reports whether rawurl is from the request's origin or a trusted
+// origin, the scheme and port must be the same too.
+func (c *csrf) trusted(ctx *water.Context, rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	// Origin "null" has no host
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	o := origin(u)
+	if o == origin(&url.URL{Scheme: c.scheme(ctx), Host: ctx.Req.Host}) {
+		return true
+	}
+	return c.origins[o]
+}
+
+// scheme returns the scheme of the request, ProxyHeader is trusted only if
+// it's set.
+func (c *csrf) scheme(ctx *water.Context) string {
+	if c.ProxyHeader != "" {
+		if v := ctx.Req.Header.Get(c.ProxyHeader); v != "" {
+			// the first proxy's
+			if i := strings.IndexByte(v, ','); i >= 0 {
+				v = v[:i]
+			}
+			return strings.ToLower(strings.TrimSpace(v))
+		}
+	}
+	if ctx.Req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// origin returns the lowercase scheme://host[:port] of u without the default
+// port of the scheme.
+func origin(u *url.URL) string {
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if (scheme == "http" && strings.HasSuffix(host, ":80")) || (scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndexByte(host, ':')]
+	}
+	return scheme + "://" + host
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 The Water Authors
+
+package csrf
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/internal/pathutil"
+)
+
+// exemptKey is the ctx.Environ key of the Exempt flag
+const exemptKey = "CSRFExempt"
+
+// Exempt is the handler marking the request exempt from validation, e.g. for
+// a webhook route. water runs the Before handlers first, so put it before the
+// middleware in the handlers of the route:
+//
+//	protect := csrf.New(o)
+//	router.Post("/webhook", csrf.Exempt, protect, hook)
+//	router.Post("/user", protect, saveUser)
+func Exempt(ctx *water.Context) {
+	if !exempted(ctx) {
+		ctx.Environ.Set(exemptKey, true)
+	}
+}
+
+func exempted(ctx *water.Context) bool {
+	v, _ := ctx.Environ.Get(exemptKey).(bool)
+	return v
+}
+
+// skip returns why the request bypasses the middleware, it's empty if not.
+func (c *csrf) skip(ctx *water.Context) string {
+	p := ctx.Req.URL.Path
+
+	for _, pattern := range c.SkipPaths {
+		if matchPath(pattern, ctx.Req.Method, p) {
+			return "path " + pattern
+		}
+	}
+	// browsers don't add these headers to a forged request
+	for _, h := range c.SkipHeaders {
+		if ctx.Req.Header.Get(h) != "" {
+			return "header " + h
+		}
+	}
+	return ""
+}
+
+// matchPath matches a SkipPaths pattern, which may start with a method, e.g.
+// "POST /upload".
+func matchPath(pattern, method, p string) bool {
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		if !strings.EqualFold(pattern[:i], method) {
+			return false
+		}
+		pattern = strings.TrimSpace(pattern[i+1:])
+	}
+	return pathutil.Match(pattern, p)
+}
+
+func (c *csrf) initSkip() {
+	// normalized in a copy, the default and the caller's slice are shared
+	methods := c.IgnoreMethods
+	if methods == nil {
+		methods = ignoreMethods
+	}
+	c.IgnoreMethods = make([]string, len(methods))
+	for i, m := range methods {
+		c.IgnoreMethods[i] = strings.ToUpper(m)
+	}
+
+	for _, h := range c.SkipHeaders {
+		if http.CanonicalHeaderKey(h) == "Cookie" {
+			panic("csrf2 : Cookie can't be a SkipHeaders")
+		}
+	}
+
+	if c.OnSkip == nil {
+		c.OnSkip = func(ctx *water.Context, reason string) {
+			log.Println("csrf2 : skip", ctx.Req.Method, ctx.Req.URL.Path, "by", reason)
+		}
+	}
+}
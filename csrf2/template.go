@@ -0,0 +1,23 @@
+// Copyright 2016 The Water Authors
+
+package csrf
+
+import (
+	"html/template"
+
+	"github.com/meilihao/water-contrib/internal/csrfutil"
+)
+
+// FuncMap returns the template helpers, e.g. for render.RenderOption.Funcs.
+// token is ctx.Environ["CSRF"], and is masked again for every use:
+//
+//	{{csrfField .csrf}}  the hidden input of a form
+//	{{csrfMeta .csrf}}   the meta tags of the token and header name
+//	{{csrfScript}}       the script sending the header with fetch/XHR, it
+//	                     needs csrfMeta
+//
+// csrfField is named Field and csrfMeta sends Header, the default extractor
+// accepts both.
+func (c *csrf) FuncMap() template.FuncMap {
+	return csrfutil.FuncMap(c.field(), c.header())
+}
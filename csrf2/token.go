@@ -4,61 +4,156 @@
 package csrf
 
 import (
-	"bytes"
 	"crypto/hmac"
-	"crypto/sha1"
-	"crypto/subtle"
+	"crypto/sha256"
 	"encoding/base64"
-	"fmt"
 	"strconv"
+	"strings"
 	"time"
-)
 
-const (
-	TIMEOUT = 24 * time.Hour
+	"github.com/meilihao/water"
 )
 
-func generateToken(key, id string, now time.Time) string {
-	h := hmac.New(sha1.New, []byte(key))
-	fmt.Fprintf(h, "%s:%d", id, now.UnixNano())
-	token := fmt.Sprintf("%s:%d", h.Sum(nil), now.UnixNano())
-	return base64.URLEncoding.EncodeToString([]byte(token))
+// tokenVersion is the first field of the token payload
+const tokenVersion = "1"
+
+// Key is a secret signing tokens, Id is put in the token to find the key
+// while validating.
+type Key struct {
+	Id     string
+	Secret string
+}
+
+func (c *csrf) initKeys() {
+	if len(c.Keys) == 0 {
+		c.Keys = []Key{{Id: "0", Secret: c.Secret}}
+	}
+
+	ids := make(map[string]bool, len(c.Keys))
+	for _, k := range c.Keys {
+		if len(k.Secret) < 16 {
+			panic("csrf2 : csrf need len(secret) >= 16")
+		}
+		if k.Id == "" || strings.Contains(k.Id, "|") || ids[k.Id] {
+			panic("csrf2 : invalid or duplicate key id " + k.Id)
+		}
+		ids[k.Id] = true
+	}
+
+	if c.TTL <= 0 {
+		c.TTL = 24 * time.Hour
+	}
+	if c.ClockSkew <= 0 {
+		c.ClockSkew = time.Minute
+	}
+}
+
+func (c *csrf) key(id string) (Key, bool) {
+	for _, k := range c.Keys {
+		if k.Id == id {
+			return k, true
+		}
+	}
+	return Key{}, false
 }
 
-func validToken(token, secret, id string) bool {
-	// Decode the token.
-	data, err := base64.URLEncoding.DecodeString(token)
+// The token is base64(payload) "." base64(mac), the payload is
+// "version|key id|issue time|action" and the mac also covers session id and
+// the claims, which aren't carried by the token.
+func (c *csrf) generateToken(action, id string, claims []string, now time.Time) string {
+	k := c.Keys[0]
+	payload := strings.Join([]string{tokenVersion, k.Id, strconv.FormatInt(now.Unix(), 10), action}, "|")
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(sign(k, payload, id, claims))
+}
+
+// checkToken validates token for the request of path action, a token without
+// action is valid for all paths. It returns why token is invalid, or "".
+func (c *csrf) checkToken(token, action, id string, claims []string) Reason {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return ReasonMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return ReasonMalformed
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(token[i+1:])
 	if err != nil {
-		return false
+		return ReasonMalformed
 	}
 
-	// Extract the issue time of the token.
-	sep := bytes.LastIndex(data, []byte{':'})
-	if sep < 0 {
-		return false
+	fields := strings.SplitN(string(payload), "|", 4)
+	if len(fields) != 4 || fields[0] != tokenVersion {
+		return ReasonMalformed
 	}
-	nanos, err := strconv.ParseInt(string(data[sep+1:]), 10, 64)
+	unix, err := strconv.ParseInt(fields[2], 10, 64)
 	if err != nil {
-		return false
+		return ReasonMalformed
+	}
+	k, ok := c.key(fields[1])
+	if !ok {
+		return ReasonMismatch
+	}
+	if fields[3] != "" && fields[3] != action {
+		return ReasonMismatch
 	}
-	issueTime := time.Unix(0, nanos)
 
+	issueTime := time.Unix(unix, 0)
 	now := time.Now()
 	// Check that the token is not expired.
-	if now.Sub(issueTime) >= TIMEOUT {
-		return false
+	if now.Sub(issueTime) >= c.TTL {
+		return ReasonExpired
+	}
+	// Check that the token is not from the future, it's allowed in ClockSkew
+	// in case the machine issuing the token is ahead.
+	if issueTime.After(now.Add(c.ClockSkew)) {
+		return ReasonExpired
 	}
 
-	// Check that the token is not from the future.
-	// Allow 1 minute grace period in case the token is being verified on a
-	// machine whose clock is behind the machine that issued the token.
-	if issueTime.After(now.Add(1 * time.Minute)) {
-		return false
+	// Use constant time comparison to avoid timing attacks.
+	if !hmac.Equal(mac, sign(k, string(payload), id, claims)) {
+		return ReasonMismatch
 	}
+	return ""
+}
 
-	expected := generateToken(secret, id, issueTime)
+func (c *csrf) validToken(token, action, id string, claims []string) bool {
+	return c.checkToken(token, action, id, claims) == ""
+}
 
-	// Check that the token matches the expected value.
-	// Use constant time comparison to avoid timing attacks.
-	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+func sign(k Key, payload, id string, claims []string) []byte {
+	h := hmac.New(sha256.New, []byte(k.Secret))
+	h.Write([]byte(payload))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	for _, v := range claims {
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+	}
+	return h.Sum(nil)
+}
+
+// GenerateToken returns a token bound to session id and claims.
+func (c *csrf) GenerateToken(id string, claims ...string) string {
+	return c.generateToken("", id, claims, time.Now())
+}
+
+// ValidateToken validates a token of GenerateToken.
+func (c *csrf) ValidateToken(token, id string, claims ...string) bool {
+	return c.validToken(token, "", id, claims)
+}
+
+// TokenFor returns a token of the request's session or client, which is
+// only valid for the request to path action, e.g. the action of a form.
+func (c *csrf) TokenFor(ctx *water.Context, action string) string {
+	return c.generateToken(action, c.id(ctx), c.claims(ctx), time.Now())
+}
+
+func (c *csrf) claims(ctx *water.Context) []string {
+	if c.Claims == nil {
+		return nil
+	}
+	return c.Claims(ctx)
 }
@@ -0,0 +1,114 @@
+// Copyright 2016 The Water Authors
+
+// Package csrfutil has the token masking and the template helpers shared by
+// csrf and csrf2.
+package csrfutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+// MaskPrefix marks a masked token, tokens may have any other format
+const MaskPrefix = "~"
+
+// Mask XORs token with a one-time pad and returns MaskPrefix +
+// base64(pad + masked), so a token rendered in compressed pages changes every
+// time (BREACH).
+func Mask(token string) string {
+	n := len(token)
+	if n == 0 {
+		return ""
+	}
+	bs := make([]byte, 2*n)
+	if _, err := rand.Read(bs[:n]); err != nil {
+		// the token is still valid unmasked
+		return token
+	}
+	for i := 0; i < n; i++ {
+		bs[n+i] = bs[i] ^ token[i]
+	}
+	return MaskPrefix + base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// Unmask returns the token of a masked one, others are returned as they are.
+func Unmask(s string) string {
+	if !strings.HasPrefix(s, MaskPrefix) {
+		return s
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(s[len(MaskPrefix):])
+	if err != nil || len(bs)%2 != 0 {
+		return s
+	}
+	n := len(bs) / 2
+	for i := 0; i < n; i++ {
+		bs[n+i] ^= bs[i]
+	}
+	return string(bs[n:])
+}
+
+// Script sends the token of csrfMeta by header with the unsafe same-origin
+// requests of fetch and XMLHttpRequest.
+const Script = `<script>
+(function() {
+	var header = document.querySelector('meta[name="csrf-header"]'),
+		token = document.querySelector('meta[name="csrf-token"]');
+	if (!header || !token) return;
+	header = header.content;
+	token = token.content;
+
+	var safe = /^(GET|HEAD|OPTIONS|TRACE)$/i;
+	function sameOrigin(url) {
+		return new URL(url, location.href).origin === location.origin;
+	}
+
+	if (window.fetch) {
+		var fetch = window.fetch;
+		window.fetch = function(input, init) {
+			init = init || {};
+			var req = input instanceof Request ? input : null,
+				method = init.method || (req ? req.method : "GET");
+			if (!safe.test(method) && sameOrigin(req ? req.url : String(input))) {
+				var headers = new Headers(init.headers || (req ? req.headers : undefined));
+				headers.set(header, token);
+				init.headers = headers;
+			}
+			return fetch.call(this, input, init);
+		};
+	}
+
+	var open = XMLHttpRequest.prototype.open,
+		send = XMLHttpRequest.prototype.send;
+	XMLHttpRequest.prototype.open = function(method, url) {
+		this._csrf = !safe.test(method) && sameOrigin(url);
+		return open.apply(this, arguments);
+	};
+	XMLHttpRequest.prototype.send = function() {
+		if (this._csrf) this.setRequestHeader(header, token);
+		return send.apply(this, arguments);
+	};
+})();
+</script>`
+
+// FuncMap returns csrfField, csrfMeta and csrfScript, the token of a page is
+// masked again for every use. csrfField renders the hidden input named
+// field, csrfMeta the meta tags of the token and the header name for Script.
+func FuncMap(field, header string) template.FuncMap {
+	return template.FuncMap{
+		"csrfField": func(token string) template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+				template.HTMLEscapeString(field), template.HTMLEscapeString(Mask(Unmask(token)))))
+		},
+		"csrfMeta": func(token string) template.HTML {
+			return template.HTML(fmt.Sprintf(`<meta name="csrf-header" content="%s">`+"\n"+`<meta name="csrf-token" content="%s">`,
+				template.HTMLEscapeString(header), template.HTMLEscapeString(Mask(Unmask(token)))))
+		},
+		"csrfScript": func() template.HTML {
+			return template.HTML(Script)
+		},
+	}
+}
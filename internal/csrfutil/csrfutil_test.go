@@ -0,0 +1,39 @@
+// Copyright 2016 The Water Authors
+
+package csrfutil
+
+import (
+	"bytes"
+	"html/template"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Mask(t *testing.T) {
+	Convey("Mask and unmask token", t, func() {
+		So(Unmask(Mask("abc.def")), ShouldEqual, "abc.def")
+		So(Mask("abc"), ShouldNotEqual, Mask("abc"))
+		So(Mask("abc"), ShouldStartWith, MaskPrefix)
+		So(Mask(""), ShouldEqual, "")
+
+		// unmasked or broken tokens are returned as they are
+		So(Unmask("abc"), ShouldEqual, "abc")
+		So(Unmask(MaskPrefix+"!"), ShouldEqual, MaskPrefix+"!")
+		So(Unmask(Mask("abc")[1:]), ShouldNotEqual, "abc")
+	})
+}
+
+func Test_FuncMap(t *testing.T) {
+	Convey("Render field and meta by their names", t, func() {
+		tpl := template.Must(template.New("page").Funcs(FuncMap("_csrf", "X-CSRF")).Parse(
+			`{{csrfField .}}{{csrfMeta .}}{{csrfScript}}`))
+		var buf bytes.Buffer
+		So(tpl.Execute(&buf, "abc"), ShouldBeNil)
+
+		page := buf.String()
+		So(page, ShouldContainSubstring, `<input type="hidden" name="_csrf" value="~`)
+		So(page, ShouldContainSubstring, `<meta name="csrf-header" content="X-CSRF">`)
+		So(page, ShouldContainSubstring, Script)
+	})
+}
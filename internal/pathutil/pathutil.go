@@ -0,0 +1,20 @@
+// Copyright 2016 The Water Authors
+
+// Package pathutil matches request paths against the SkipPaths patterns of
+// the middleware.
+package pathutil
+
+import (
+	"path"
+	"strings"
+)
+
+// Match reports whether p matches the path.Match pattern, a pattern ending
+// with "**" matches the prefix, e.g. "/static/**".
+func Match(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "**") {
+		return strings.HasPrefix(p, strings.TrimSuffix(pattern, "**"))
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
@@ -0,0 +1,20 @@
+// Copyright 2016 The Water Authors
+
+package pathutil
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Match(t *testing.T) {
+	Convey("Match path patterns", t, func() {
+		So(Match("/static/**", "/static/js/a.js"), ShouldBeTrue)
+		So(Match("/static/**", "/static"), ShouldBeFalse)
+		So(Match("/*.ico", "/favicon.ico"), ShouldBeTrue)
+		So(Match("/*.ico", "/a/favicon.ico"), ShouldBeFalse)
+		So(Match("/hooks/*/ping", "/hooks/a/ping"), ShouldBeTrue)
+		So(Match("[", "/"), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/meilihao/water"
+)
+
+// AdminAction is an operation of the admin handler.
+type AdminAction int
+
+const (
+	AdminList AdminAction = iota
+	AdminView
+	AdminDelete
+)
+
+func (a AdminAction) String() string {
+	switch a {
+	case AdminList:
+		return "list"
+	case AdminView:
+		return "view"
+	case AdminDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+type AdminOptions struct {
+	// Url the url of the admin api, default is "/admin/sessions"
+	Url string
+	// Session is the options of the inspected session middleware
+	Session *Options
+	// Authorize reports whether the request may do the action, it's required
+	Authorize func(ctx *water.Context, action AdminAction) bool
+	// PageSize is the max number of sessions listed once, default is 100
+	PageSize int
+}
+
+// adminSession is a session shown by the admin handler.
+type adminSession struct {
+	Id         string      `json:"id"`
+	CreateTime time.Time   `json:"create_time"`
+	LastTime   time.Time   `json:"last_time"`
+	Version    int64       `json:"version,omitempty"`
+	UserId     string      `json:"user_id,omitempty"`
+	ClientNet  string      `json:"client_net,omitempty"`
+	UserAgent  string      `json:"user_agent,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// Admin mounts the session admin api:
+//
+//	GET    Url?cursor=&limit=  lists live sessions, Store must implement Scanner
+//	GET    Url/session?id=     shows the metadata and data of a session
+//	DELETE Url/session?id=     deletes a session and its user index
+func Admin(r *water.Router, opt *AdminOptions) {
+	if !r.IsParent() {
+		panic("sub router not allowed : Admin()")
+	}
+	if opt.Session == nil || opt.Session.Store == nil {
+		panic("session : admin need Session.Store")
+	}
+	if opt.Authorize == nil {
+		panic("session : admin need Authorize")
+	}
+
+	if opt.Url == "" {
+		opt.Url = "/admin/sessions"
+	}
+	if opt.PageSize <= 0 {
+		opt.PageSize = 100
+	}
+
+	r.Get(opt.Url, opt.authorize(AdminList), opt.list)
+	r.Get(opt.Url+"/session", opt.authorize(AdminView), opt.view)
+	r.Delete(opt.Url+"/session", opt.authorize(AdminDelete), opt.delete)
+}
+
+func (opt *AdminOptions) authorize(action AdminAction) water.HandlerFunc {
+	return func(ctx *water.Context) {
+		if !opt.Authorize(ctx, action) {
+			writeJSON(ctx, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+func (opt *AdminOptions) list(ctx *water.Context) {
+	scanner, ok := opt.Session.Store.(Scanner)
+	if !ok {
+		writeJSON(ctx, http.StatusNotImplemented, map[string]string{"error": "store doesn't support listing"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(ctx.Req.URL.Query().Get("limit"))
+	if limit <= 0 || limit > opt.PageSize {
+		limit = opt.PageSize
+	}
+
+	ids, next, err := scanner.Scan(ctx.Req.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		writeJSON(ctx, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ls := make([]*adminSession, 0, len(ids))
+	now := time.Now()
+	for _, id := range ids {
+		// expired by others, or by the timeouts of the middleware
+		c := opt.Session.Store.Get(id)
+		if c == nil || opt.Session.expired(c, now) != ExpireNone {
+			continue
+		}
+
+		ls = append(ls, &adminSession{
+			Id:         id,
+			CreateTime: c.CreateTime,
+			LastTime:   c.LastTime,
+			UserId:     c.UserId,
+		})
+	}
+
+	writeJSON(ctx, http.StatusOK, map[string]interface{}{
+		"sessions": ls,
+		"next":     next,
+	})
+}
+
+func (opt *AdminOptions) view(ctx *water.Context) {
+	id := ctx.Req.URL.Query().Get("id")
+	c := opt.Session.Store.Get(id)
+	if id == "" || c == nil {
+		writeJSON(ctx, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+
+	s := &adminSession{
+		Id:         id,
+		CreateTime: c.CreateTime,
+		LastTime:   c.LastTime,
+		Version:    c.Version,
+		UserId:     c.UserId,
+		ClientNet:  c.ClientNet,
+		UserAgent:  c.UserAgent,
+		Data:       c.Data,
+	}
+	// Data decoded by the store's serializer may not be json friendly
+	if _, err := json.Marshal(c.Data); err != nil {
+		s.Data = fmt.Sprintf("%#v", c.Data)
+	}
+
+	writeJSON(ctx, http.StatusOK, s)
+}
+
+func (opt *AdminOptions) delete(ctx *water.Context) {
+	id := ctx.Req.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(ctx, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+
+	// a session bound to a user is revoked, so it leaves the index too
+	var err error
+	c := opt.Session.Store.Get(id)
+	if indexer, ok := opt.Session.Store.(Indexer); ok && c != nil && c.UserId != "" {
+		err = opt.Session.revoke(ctx, indexer, c.UserId, id)
+	} else if err = opt.Session.Store.Del(id); err == nil {
+		opt.Session.emit(ctx, &Event{
+			Type: EventDestroyed,
+			Id:   id,
+		})
+	}
+	if err != nil {
+		writeJSON(ctx, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ctx.ResponseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(ctx *water.Context, code int, v interface{}) {
+	ctx.ResponseWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+	ctx.ResponseWriter.WriteHeader(code)
+	json.NewEncoder(ctx.ResponseWriter).Encode(v)
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/meilihao/water"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Admin(t *testing.T) {
+	Convey("Admin api", t, func() {
+		store := NewMemoryStore(0)
+		for _, id := range []string{"a", "b", "c"} {
+			store.Set(id, &Container{Data: map[string]string{"user": id}, Changed: true, CreateTime: time.Now(), LastTime: time.Now()})
+		}
+		// c is bound to a user, d is idle
+		store.Set("c", &Container{Changed: true, CreateTime: time.Now(), LastTime: time.Now(), UserId: "1"})
+		store.Bind("1", &SessionInfo{Id: "c", UserId: "1"})
+		store.Set("d", &Container{Changed: true, CreateTime: time.Now(), LastTime: time.Now().Add(-2 * time.Hour)})
+
+		var destroyed string
+		opt := &Options{Store: store, IdleTimeout: time.Hour, OnEvent: func(e *Event) {
+			if e.Type == EventDestroyed {
+				destroyed = e.Id
+			}
+		}}
+
+		router := water.NewRouter()
+		Admin(router, &AdminOptions{
+			Session:  opt,
+			PageSize: 2,
+			Authorize: func(ctx *water.Context, action AdminAction) bool {
+				return ctx.Req.Header.Get("X-Role") == "admin" ||
+					(ctx.Req.Header.Get("X-Role") == "support" && action != AdminDelete)
+			},
+		})
+
+		do := func(method, url, role string, v interface{}) int {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, url, nil)
+			req.Header.Set("X-Role", role)
+			router.ServeHTTP(resp, req)
+			if v != nil {
+				So(json.Unmarshal(resp.Body.Bytes(), v), ShouldBeNil)
+			}
+			return resp.Code
+		}
+
+		var page struct {
+			Sessions []*adminSession
+			Next     string
+		}
+		So(do("GET", "/admin/sessions", "support", &page), ShouldEqual, http.StatusOK)
+		So(page.Sessions, ShouldHaveLength, 2)
+		So(page.Sessions[0].Id, ShouldEqual, "a")
+		So(page.Sessions[0].Data, ShouldBeNil)
+		So(page.Next, ShouldEqual, "b")
+
+		So(do("GET", "/admin/sessions?cursor=b&limit=10", "support", &page), ShouldEqual, http.StatusOK)
+		So(page.Sessions, ShouldHaveLength, 1)
+		So(page.Sessions[0].Id, ShouldEqual, "c")
+		So(page.Sessions[0].UserId, ShouldEqual, "1")
+		So(page.Next, ShouldBeEmpty)
+
+		var s struct {
+			Id   string
+			Data map[string]string
+		}
+		So(do("GET", "/admin/sessions/session?id=b", "support", &s), ShouldEqual, http.StatusOK)
+		So(s.Data["user"], ShouldEqual, "b")
+		So(do("GET", "/admin/sessions/session?id=x", "support", nil), ShouldEqual, http.StatusNotFound)
+
+		So(do("DELETE", "/admin/sessions/session?id=b", "support", nil), ShouldEqual, http.StatusForbidden)
+		So(do("GET", "/admin/sessions", "", nil), ShouldEqual, http.StatusForbidden)
+		So(store.Get("b"), ShouldNotBeNil)
+
+		So(do("DELETE", "/admin/sessions/session?id=b", "admin", nil), ShouldEqual, http.StatusNoContent)
+		So(store.Get("b"), ShouldBeNil)
+		So(destroyed, ShouldEqual, "b")
+
+		// the user index is cleaned too
+		So(do("DELETE", "/admin/sessions/session?id=c", "admin", nil), ShouldEqual, http.StatusNoContent)
+		So(store.Get("c"), ShouldBeNil)
+		So(destroyed, ShouldEqual, "c")
+		infos, err := store.Sessions("1")
+		So(err, ShouldBeNil)
+		So(infos, ShouldBeEmpty)
+	})
+
+	Convey("Internal keys", t, func() {
+		So(IsInternalKey("lock:a"), ShouldBeTrue)
+		So(IsInternalKey("cas:a"), ShouldBeTrue)
+		So(IsInternalKey("user:1"), ShouldBeTrue)
+		So(IsInternalKey("abc"), ShouldBeFalse)
+	})
+}
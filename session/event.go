@@ -0,0 +1,173 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meilihao/water"
+)
+
+// ErrDestroyed is returned when a destroyed session is regenerated.
+var ErrDestroyed = errors.New("session : session is destroyed")
+
+// EventType is the kind of session event.
+type EventType int
+
+const (
+	// EventCreated is sent when a fresh session is started
+	EventCreated EventType = iota + 1
+	// EventLoaded is sent when a live session is loaded from store
+	EventLoaded
+	// EventRegenerated is sent when the id of a session is changed, Event.OldId is the previous one
+	EventRegenerated
+	// EventDestroyed is sent when a session is deleted by Destroy or Options.RevokeSession
+	EventDestroyed
+	// EventExpired is sent when a session is invalidated by timeout, Event.Reason tells why
+	EventExpired
+	// EventStoreError is sent when store or tracker fails, Event.Op and Event.Err tell the failure
+	EventStoreError
+	// EventSuspicious is sent when the fingerprint of a session mismatches, Event.Mismatch tells the parts
+	EventSuspicious
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCreated:
+		return "created"
+	case EventLoaded:
+		return "loaded"
+	case EventRegenerated:
+		return "regenerated"
+	case EventDestroyed:
+		return "destroyed"
+	case EventExpired:
+		return "expired"
+	case EventStoreError:
+		return "store_error"
+	case EventSuspicious:
+		return "suspicious"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes what happens to a session, request fields are empty when
+// it's not sent in a request.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Id       string
+	OldId    string
+	Reason   ExpireReason
+	Op       string
+	Err      error
+	Mismatch Mismatch
+
+	Method    string
+	Path      string
+	IP        string
+	UserAgent string
+}
+
+func (opt *Options) emit(ctx *water.Context, e *Event) {
+	if opt.OnEvent == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	if ctx != nil {
+		e.Method = ctx.Req.Method
+		e.Path = ctx.Req.URL.Path
+		e.IP = clientIP(ctx.Req)
+		e.UserAgent = ctx.Req.UserAgent()
+	}
+	opt.OnEvent(e)
+}
+
+// fail reports an error of op to Options.ErrorHandler, it's logged by default.
+func (sess *Session) fail(op string, err error) {
+	sess.manager.emit(sess.ctx, &Event{
+		Type: EventStoreError,
+		Id:   sess.Id,
+		Op:   op,
+		Err:  err,
+	})
+
+	if sess.manager.ErrorHandler != nil {
+		sess.manager.ErrorHandler(sess.ctx, op, err)
+		return
+	}
+	log.Println("session : " + op + " error:" + err.Error())
+}
+
+// auditRecord is a line written by AuditLogger.
+type auditRecord struct {
+	Time      string `json:"time"`
+	Event     string `json:"event"`
+	Session   string `json:"session,omitempty"`
+	OldId     string `json:"old_session,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Mismatch  string `json:"mismatch,omitempty"`
+	Op        string `json:"op,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Method    string `json:"method,omitempty"`
+	Path      string `json:"path,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// NewAuditLogger returns an Options.OnEvent which writes an event as a json
+// line to w. Session ids are credentials, so only their hashes are written.
+func NewAuditLogger(w io.Writer) func(*Event) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+
+	return func(e *Event) {
+		r := &auditRecord{
+			Time:      e.Time.UTC().Format(time.RFC3339Nano),
+			Event:     e.Type.String(),
+			Session:   HashId(e.Id),
+			OldId:     HashId(e.OldId),
+			Mismatch:  e.Mismatch.String(),
+			Op:        e.Op,
+			Method:    e.Method,
+			Path:      e.Path,
+			IP:        e.IP,
+			UserAgent: e.UserAgent,
+		}
+		if e.Type == EventExpired {
+			r.Reason = e.Reason.String()
+		}
+		if e.Err != nil {
+			r.Error = e.Err.Error()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(r); err != nil {
+			log.Println("session : audit error:" + err.Error())
+		}
+	}
+}
+
+// HashId returns a short hash of a session id to correlate logs without
+// leaking the id.
+func HashId(id string) string {
+	if id == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,166 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meilihao/water"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Event(t *testing.T) {
+	for name, store := range map[string]func() Store{
+		"testStore":   func() Store { return newTestStore() },
+		"MemoryStore": func() Store { return NewMemoryStore(0) },
+	} {
+		Convey("Lifecycle events of "+name, t, func() {
+			var events []*Event
+			opt := newTestOptions()
+			opt.Store = store()
+			opt.OnEvent = func(e *Event) {
+				events = append(events, e)
+			}
+
+			router := water.NewRouter()
+			router.Before(New(opt))
+			router.Get("/", func(ctx *water.Context) {
+				Get(ctx).Data = "a"
+			})
+			router.Get("/login", func(ctx *water.Context) {
+				So(Get(ctx).Regenerate(), ShouldBeNil)
+			})
+			router.Get("/logout", func(ctx *water.Context) {
+				sess := Get(ctx)
+				So(sess.Destroy(), ShouldBeNil)
+				So(sess.Regenerate(), ShouldEqual, ErrDestroyed)
+			})
+
+			resp := serve(router, "/", "")
+			cookie := resp.Header().Get("Set-Cookie")
+			So(events, ShouldHaveLength, 1)
+			So(events[0].Type, ShouldEqual, EventCreated)
+			So(events[0].Path, ShouldEqual, "/")
+			So(events[0].Method, ShouldEqual, "GET")
+			id := events[0].Id
+
+			resp = serve(router, "/login", cookie)
+			So(events, ShouldHaveLength, 3)
+			So(events[1].Type, ShouldEqual, EventLoaded)
+			So(events[2].Type, ShouldEqual, EventRegenerated)
+			So(events[2].OldId, ShouldEqual, id)
+			So(events[2].Id, ShouldNotEqual, id)
+			So(opt.Store.Get(id), ShouldBeNil)
+			So(opt.Store.Get(events[2].Id).Data, ShouldEqual, "a")
+
+			cookie = resp.Header().Get("Set-Cookie")
+			resp = serve(router, "/logout", cookie)
+			So(events, ShouldHaveLength, 5)
+			So(events[4].Type, ShouldEqual, EventDestroyed)
+			So(opt.Store.Get(events[4].Id), ShouldBeNil)
+			So(resp.Header().Get("Set-Cookie"), ShouldContainSubstring, "Max-Age=0")
+		})
+
+		Convey("Session without data is created once on "+name, t, func() {
+			var events []*Event
+			opt := newTestOptions()
+			opt.Store = store()
+			opt.OnEvent = func(e *Event) {
+				events = append(events, e)
+			}
+			news := 0
+			opt.OnSessionNew = func(*Session) {
+				news++
+			}
+
+			isNew := false
+			router := water.NewRouter()
+			router.Before(New(opt))
+			router.Get("/", func(ctx *water.Context) {
+				isNew = Get(ctx).IsNew()
+			})
+
+			resp := serve(router, "/", "")
+			So(isNew, ShouldBeTrue)
+			cookie := resp.Header().Get("Set-Cookie")
+			c := opt.Store.Get(events[0].Id)
+			So(c, ShouldNotBeNil)
+			So(c.Data, ShouldBeNil)
+
+			serve(router, "/", cookie)
+			So(isNew, ShouldBeFalse)
+			So(news, ShouldEqual, 1)
+			So(events, ShouldHaveLength, 2)
+			So(events[0].Type, ShouldEqual, EventCreated)
+			So(events[1].Type, ShouldEqual, EventLoaded)
+		})
+	}
+
+	Convey("Expired and store error", t, func() {
+		var events []*Event
+		var handled string
+		opt := newTestOptions()
+		opt.IdleTimeout = time.Hour
+		opt.OnEvent = func(e *Event) {
+			events = append(events, e)
+		}
+		opt.ErrorHandler = func(ctx *water.Context, op string, err error) {
+			handled = op + ":" + err.Error()
+		}
+
+		router := water.NewRouter()
+		router.Before(New(opt))
+		router.Get("/", func(ctx *water.Context) {
+			Get(ctx).Data = "a"
+		})
+
+		serve(router, "/", "")
+		id := events[0].Id
+		c := opt.Store.Get(id)
+		c.LastTime = time.Now().Add(-2 * time.Hour)
+		c.Changed = true
+		So(opt.Store.Set(id, c), ShouldBeNil)
+
+		opt.Store.(*testStore).err = errors.New("down")
+		serve(router, "/", "session="+id)
+		So(events, ShouldHaveLength, 4)
+		So(events[1].Type, ShouldEqual, EventExpired)
+		So(events[1].Reason, ShouldEqual, ExpireIdle)
+		So(events[1].Id, ShouldEqual, id)
+		So(events[2].Type, ShouldEqual, EventCreated)
+		So(events[3].Type, ShouldEqual, EventStoreError)
+		So(events[3].Op, ShouldEqual, "store")
+		So(handled, ShouldEqual, "store:down")
+	})
+
+	Convey("Audit logger", t, func() {
+		var buf bytes.Buffer
+		audit := NewAuditLogger(&buf)
+
+		audit(&Event{Type: EventExpired, Time: time.Now(), Id: "secret", Reason: ExpireAbsolute, IP: "1.2.3.4"})
+		audit(&Event{Type: EventStoreError, Time: time.Now(), Op: "lock", Err: ErrLockTimeout})
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		So(lines, ShouldHaveLength, 2)
+		So(buf.String(), ShouldNotContainSubstring, "secret")
+
+		var r map[string]string
+		So(json.Unmarshal([]byte(lines[0]), &r), ShouldBeNil)
+		So(r["event"], ShouldEqual, "expired")
+		So(r["session"], ShouldEqual, HashId("secret"))
+		So(r["reason"], ShouldEqual, "absolute timeout")
+		So(r["ip"], ShouldEqual, "1.2.3.4")
+
+		So(json.Unmarshal([]byte(lines[1]), &r), ShouldBeNil)
+		So(r["event"], ShouldEqual, "store_error")
+		So(r["error"], ShouldEqual, ErrLockTimeout.Error())
+	})
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FingerprintPolicy is the action when a session is used by a client other
+// than the one creating it.
+type FingerprintPolicy int
+
+const (
+	// FingerprintIgnore disables the fingerprint binding
+	FingerprintIgnore FingerprintPolicy = iota
+	// FingerprintLog logs the mismatch and keeps the session
+	FingerprintLog
+	// FingerprintRegenerate gives the request a fresh session with a new id,
+	// the stored session is kept for its owner
+	FingerprintRegenerate
+	// FingerprintDestroy deletes the stored session and gives the request a
+	// fresh one
+	FingerprintDestroy
+)
+
+// Mismatch tells which parts of the fingerprint don't match.
+type Mismatch int
+
+const (
+	MismatchIP Mismatch = 1 << iota
+	MismatchUserAgent
+)
+
+func (m Mismatch) String() string {
+	var ls []string
+	if m&MismatchIP != 0 {
+		ls = append(ls, "ip")
+	}
+	if m&MismatchUserAgent != 0 {
+		ls = append(ls, "user_agent")
+	}
+	return strings.Join(ls, ",")
+}
+
+// clientNet returns the subnet of ip, so clients moving inside their network
+// still match.
+func (opt *Options) clientNet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(opt.IPv4Mask, 32)).String() + "/" + strconv.Itoa(opt.IPv4Mask)
+	}
+	return parsed.Mask(net.CIDRMask(opt.IPv6Mask, 128)).String() + "/" + strconv.Itoa(opt.IPv6Mask)
+}
+
+// bind stores the fingerprint of the request in the container.
+func (sess *Session) bind() {
+	sess.Container.ClientNet = sess.manager.clientNet(clientIP(sess.ctx.Req))
+	sess.Container.UserAgent = sess.ctx.Req.UserAgent()
+	sess.Container.Changed = true
+}
+
+// checkFingerprint compares the loaded session with the request, the policy
+// may replace it by a fresh one.
+func (sess *Session) checkFingerprint() {
+	// stored before fingerprint is enabled
+	if sess.Container.ClientNet == "" && sess.Container.UserAgent == "" {
+		sess.bind()
+		return
+	}
+
+	var m Mismatch
+	if sess.Container.ClientNet != sess.manager.clientNet(clientIP(sess.ctx.Req)) {
+		m |= MismatchIP
+	}
+	if sess.Container.UserAgent != sess.ctx.Req.UserAgent() {
+		m |= MismatchUserAgent
+	}
+	if m == 0 {
+		return
+	}
+
+	sess.manager.emit(sess.ctx, &Event{
+		Type:     EventSuspicious,
+		Id:       sess.Id,
+		Mismatch: m,
+	})
+
+	policy := sess.manager.FingerprintPolicy
+	if sess.manager.OnSuspicious != nil {
+		policy = sess.manager.OnSuspicious(sess, m)
+	}
+
+	switch policy {
+	case FingerprintLog:
+		log.Printf("session : suspicious session %s, mismatch: %s\n", HashId(sess.Id), m)
+	case FingerprintRegenerate, FingerprintDestroy:
+		if policy == FingerprintDestroy {
+			if err := sess.manager.Store.Del(sess.Id); err != nil {
+				sess.fail("del", err)
+			}
+			sess.manager.emit(sess.ctx, &Event{
+				Type: EventDestroyed,
+				Id:   sess.Id,
+			})
+		}
+
+		sess.Id = sess.manager.Generator.Gen(sess.ctx.Req)
+		sess.manager.Tracker.Set(sess.ctx, sess.Id)
+		sess.start()
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meilihao/water"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Fingerprint(t *testing.T) {
+	request := func(router *water.Router, addr, ua, cookie string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("User-Agent", ua)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	setup := func(policy FingerprintPolicy) (*Options, *water.Router, *string) {
+		opt := newTestOptions()
+		opt.FingerprintPolicy = policy
+
+		id := new(string)
+		router := water.NewRouter()
+		router.Before(New(opt))
+		router.Get("/", func(ctx *water.Context) {
+			sess := Get(ctx)
+			if sess.Data == nil {
+				sess.Data = "owner"
+			}
+			*id = sess.Id
+		})
+		return opt, router, id
+	}
+
+	Convey("Same client and subnet", t, func() {
+		opt, router, id := setup(FingerprintDestroy)
+
+		cookie := request(router, "10.0.0.1:1234", "ua", "").Header().Get("Set-Cookie")
+		owner := *id
+		c := opt.Store.Get(owner)
+		So(c.ClientNet, ShouldEqual, "10.0.0.0/24")
+		So(c.UserAgent, ShouldEqual, "ua")
+
+		request(router, "10.0.0.99:1234", "ua", cookie)
+		So(*id, ShouldEqual, owner)
+
+		Convey("IPv6", func() {
+			So(opt.clientNet("2001:db8::1"), ShouldEqual, "2001:db8::/64")
+		})
+	})
+
+	Convey("Regenerate keeps the stored session", t, func() {
+		opt, router, id := setup(FingerprintRegenerate)
+
+		cookie := request(router, "10.0.0.1:1234", "ua", "").Header().Get("Set-Cookie")
+		owner := *id
+
+		resp := request(router, "10.1.0.1:1234", "ua", cookie)
+		So(*id, ShouldNotEqual, owner)
+		So(resp.Header().Get("Set-Cookie"), ShouldContainSubstring, *id)
+		So(opt.Store.Get(owner), ShouldNotBeNil)
+		So(opt.Store.Get(*id).ClientNet, ShouldEqual, "10.1.0.0/24")
+	})
+
+	Convey("Destroy deletes the stored session", t, func() {
+		opt, router, id := setup(FingerprintDestroy)
+
+		cookie := request(router, "10.0.0.1:1234", "ua", "").Header().Get("Set-Cookie")
+		owner := *id
+
+		request(router, "10.0.0.1:1234", "curl", cookie)
+		So(*id, ShouldNotEqual, owner)
+		So(opt.Store.Get(owner), ShouldBeNil)
+	})
+
+	Convey("OnSuspicious decides", t, func() {
+		opt, router, id := setup(FingerprintDestroy)
+		var mismatch Mismatch
+		opt.OnSuspicious = func(sess *Session, m Mismatch) FingerprintPolicy {
+			mismatch = m
+			return FingerprintIgnore
+		}
+
+		cookie := request(router, "10.0.0.1:1234", "ua", "").Header().Get("Set-Cookie")
+		owner := *id
+
+		request(router, "10.1.0.1:1234", "curl", cookie)
+		So(*id, ShouldEqual, owner)
+		So(mismatch, ShouldEqual, MismatchIP|MismatchUserAgent)
+		So(mismatch.String(), ShouldEqual, "ip,user_agent")
+	})
+
+	Convey("Container keeps fingerprint", t, func() {
+		c := &Container{Data: "a", ClientNet: "10.0.0.0/24", UserAgent: "ua", Version: 2}
+
+		bs, err := EncodeContainer(GobSerializer{}, c)
+		So(err, ShouldBeNil)
+		c2, err := DecodeContainer(GobSerializer{}, bs)
+		So(err, ShouldBeNil)
+		So(c2.ClientNet, ShouldEqual, c.ClientNet)
+		So(c2.UserAgent, ShouldEqual, c.UserAgent)
+		So(c2.Data, ShouldEqual, "a")
+		version, err := PeekVersion(bs)
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, 2)
+
+		_, err = DecodeContainer(GobSerializer{}, bs[:containerHeaderLenV2+3])
+		So(err, ShouldEqual, ErrContainerVersion)
+	})
+}
@@ -7,13 +7,16 @@
 package session
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,6 +25,9 @@ type IdGenerator interface {
 	IsValid(id string) bool
 }
 
+// Sha1Generator only checks the length of id in IsValid.
+//
+// Deprecated: use Sha256Generator, whose ids are signed.
 type Sha1Generator struct {
 	hashKey string
 }
@@ -55,3 +61,86 @@ func (gen *Sha1Generator) Gen(req *http.Request) string {
 func (gen *Sha1Generator) IsValid(id string) bool {
 	return len(id) == 27
 }
+
+const (
+	// random part and HMAC tag of a signed id, 24 base64 chars each
+	sha256RandLen = 18
+	sha256TagLen  = 18
+)
+
+var _ IdGenerator = NewSha256Generator("0123456789abcdef")
+
+// Sha256Generator generates ids of crypto-random bytes with HMAC-SHA256 tag,
+// so forged or tampered ids are rejected by IsValid before reaching the store.
+type Sha256Generator struct {
+	lock sync.RWMutex
+	// keys[0] signs new ids, all keys verify
+	keys [][]byte
+}
+
+// NewSha256Generator creates a generator, the first key signs new ids and
+// the others are old keys still accepted during rotation. Keys need len >= 16.
+func NewSha256Generator(keys ...string) *Sha256Generator {
+	gen := new(Sha256Generator)
+	gen.SetKeys(keys...)
+	return gen
+}
+
+// SetKeys rotates the keys, it's safe for concurrent use.
+func (gen *Sha256Generator) SetKeys(keys ...string) {
+	if len(keys) == 0 {
+		panic("session : Sha256Generator need keys")
+	}
+
+	bs := make([][]byte, len(keys))
+	for i, k := range keys {
+		if len(k) < 16 {
+			panic("session : Sha256Generator need len(key) >= 16")
+		}
+		bs[i] = []byte(k)
+	}
+
+	gen.lock.Lock()
+	gen.keys = bs
+	gen.lock.Unlock()
+}
+
+func sha256Tag(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)[:sha256TagLen]
+}
+
+func (gen *Sha256Generator) Gen(req *http.Request) string {
+	bs := GenRandKey(sha256RandLen)
+	if len(bs) == 0 {
+		return ""
+	}
+
+	gen.lock.RLock()
+	tag := sha256Tag(gen.keys[0], bs)
+	gen.lock.RUnlock()
+
+	return base64.RawURLEncoding.EncodeToString(append(bs, tag...))
+}
+
+func (gen *Sha256Generator) IsValid(id string) bool {
+	if base64.RawURLEncoding.DecodedLen(len(id)) != sha256RandLen+sha256TagLen {
+		return false
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(bs) != sha256RandLen+sha256TagLen {
+		return false
+	}
+	data, tag := bs[:sha256RandLen], bs[sha256RandLen:]
+
+	gen.lock.RLock()
+	defer gen.lock.RUnlock()
+
+	for _, key := range gen.keys {
+		if hmac.Equal(tag, sha256Tag(key, data)) {
+			return true
+		}
+	}
+	return false
+}
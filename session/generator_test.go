@@ -0,0 +1,64 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Sha256Generator(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	Convey("Signed id", t, func() {
+		gen := NewSha256Generator("0123456789abcdef")
+
+		id := gen.Gen(req)
+		So(id, ShouldHaveLength, 48)
+		So(gen.IsValid(id), ShouldBeTrue)
+		So(gen.Gen(req), ShouldNotEqual, id)
+
+		Convey("Forged or tampered id", func() {
+			So(gen.IsValid(""), ShouldBeFalse)
+			So(gen.IsValid(strings.Repeat("a", 48)), ShouldBeFalse)
+			So(gen.IsValid(id[:47]), ShouldBeFalse)
+			So(gen.IsValid(id+"a"), ShouldBeFalse)
+
+			b := []byte(id)
+			if b[0] == 'A' {
+				b[0] = 'B'
+			} else {
+				b[0] = 'A'
+			}
+			So(gen.IsValid(string(b)), ShouldBeFalse)
+
+			// valid id of a generator with other key
+			So(gen.IsValid(NewSha256Generator("fedcba9876543210").Gen(req)), ShouldBeFalse)
+			// Sha1Generator's id
+			So(gen.IsValid(NewSha1Generator("test").Gen(req)), ShouldBeFalse)
+		})
+
+		Convey("Key rotation", func() {
+			gen.SetKeys("fedcba9876543210", "0123456789abcdef")
+			So(gen.IsValid(id), ShouldBeTrue)
+
+			id2 := gen.Gen(req)
+			So(NewSha256Generator("fedcba9876543210").IsValid(id2), ShouldBeTrue)
+
+			gen.SetKeys("fedcba9876543210")
+			So(gen.IsValid(id), ShouldBeFalse)
+			So(gen.IsValid(id2), ShouldBeTrue)
+		})
+	})
+
+	Convey("Short key", t, func() {
+		So(func() { NewSha256Generator("short") }, ShouldPanic)
+		So(func() { NewSha256Generator() }, ShouldPanic)
+	})
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/meilihao/water"
+)
+
+var (
+	// ErrIndexUnsupported is returned when the store doesn't implement Indexer.
+	ErrIndexUnsupported = errors.New("session : store doesn't support user index")
+	// ErrNotBound is returned when the session isn't in the user's index.
+	ErrNotBound = errors.New("session : session isn't bound to the user")
+)
+
+// SessionInfo describes a session bound to a user.
+type SessionInfo struct {
+	Id         string
+	UserId     string
+	CreateTime time.Time
+	LastTime   time.Time
+	IP         string
+	UserAgent  string
+}
+
+// Indexer is implemented by stores which can index sessions by user id.
+type Indexer interface {
+	// Bind adds the session to the user's index
+	Bind(userId string, info *SessionInfo) error
+	// Unbind removes the session from the user's index
+	Unbind(userId, id string) error
+	// Sessions returns the indexed sessions of a user
+	Sessions(userId string) ([]*SessionInfo, error)
+}
+
+// BindUser binds the session to a user after the user logs in, the user is
+// kept in Container.UserId, so Regenerate moves the binding to the new id.
+func (sess *Session) BindUser(userId string) error {
+	indexer, ok := sess.manager.Store.(Indexer)
+	if !ok {
+		return ErrIndexUnsupported
+	}
+
+	sess.load()
+	if sess.UserId != userId {
+		sess.UserId = userId
+		sess.Container.Changed = true
+	}
+	return indexer.Bind(userId, &SessionInfo{
+		Id:         sess.Id,
+		UserId:     userId,
+		CreateTime: sess.CreateTime,
+		LastTime:   sess.LastTime,
+		IP:         clientIP(sess.ctx.Req),
+		UserAgent:  sess.ctx.Req.UserAgent(),
+	})
+}
+
+// ListSessions returns the live sessions of a user order by LastTime desc,
+// dead ones are removed from the index.
+func (opt *Options) ListSessions(userId string) ([]*SessionInfo, error) {
+	indexer, ok := opt.Store.(Indexer)
+	if !ok {
+		return nil, ErrIndexUnsupported
+	}
+
+	infos, err := indexer.Sessions(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := make([]*SessionInfo, 0, len(infos))
+	now := time.Now()
+	for _, info := range infos {
+		c := opt.Store.Get(info.Id)
+		if c == nil || opt.expired(c, now) != ExpireNone {
+			if err = indexer.Unbind(userId, info.Id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		info.CreateTime = c.CreateTime
+		info.LastTime = c.LastTime
+		ls = append(ls, info)
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].LastTime.After(ls[j].LastTime)
+	})
+	return ls, nil
+}
+
+// RevokeSession destroys a session of the user, ErrNotBound is returned if
+// the session isn't in the user's index.
+func (opt *Options) RevokeSession(userId, id string) error {
+	indexer, ok := opt.Store.(Indexer)
+	if !ok {
+		return ErrIndexUnsupported
+	}
+
+	infos, err := indexer.Sessions(userId)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Id == id {
+			return opt.revoke(nil, indexer, userId, id)
+		}
+	}
+	return ErrNotBound
+}
+
+// revoke deletes a session and its index, ctx is nil out of a request.
+func (opt *Options) revoke(ctx *water.Context, indexer Indexer, userId, id string) error {
+	if err := opt.Store.Del(id); err != nil {
+		return err
+	}
+	opt.emit(ctx, &Event{
+		Type: EventDestroyed,
+		Id:   id,
+	})
+	return indexer.Unbind(userId, id)
+}
+
+// RevokeUser destroys all sessions of the user, e.g. "log out everywhere".
+func (opt *Options) RevokeUser(userId string) error {
+	indexer, ok := opt.Store.(Indexer)
+	if !ok {
+		return ErrIndexUnsupported
+	}
+
+	infos, err := indexer.Sessions(userId)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err = opt.revoke(nil, indexer, userId, info.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientIP returns the ip of the direct peer, proxy headers are not trusted.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
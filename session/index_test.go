@@ -0,0 +1,111 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meilihao/water"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Index(t *testing.T) {
+	Convey("List and revoke sessions of a user", t, func() {
+		opt := newTestOptions()
+		opt.Store = NewMemoryStore(0)
+
+		router := water.NewRouter()
+		router.Before(New(opt))
+		router.Get("/login", func(ctx *water.Context) {
+			sess := Get(ctx)
+			sess.Data = &testUser{Name: "chen"}
+			sess.Changed = true
+			So(sess.BindUser("1"), ShouldBeNil)
+		})
+		router.Get("/me", func(ctx *water.Context) {
+			if Get(ctx).Data == nil {
+				ctx.Forbidden()
+			}
+		})
+		router.Get("/regenerate", func(ctx *water.Context) {
+			So(Get(ctx).Regenerate(), ShouldBeNil)
+		})
+
+		login := func(ua string) string {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/login", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("User-Agent", ua)
+			router.ServeHTTP(resp, req)
+			return resp.Header().Get("Set-Cookie")
+		}
+		phone, laptop := login("phone"), login("laptop")
+
+		ls, err := opt.ListSessions("1")
+		So(err, ShouldBeNil)
+		So(ls, ShouldHaveLength, 2)
+		So(ls[0].UserAgent, ShouldEqual, "laptop")
+		So(ls[0].IP, ShouldEqual, "10.0.0.1")
+		So(ls[0].CreateTime.IsZero(), ShouldBeFalse)
+
+		Convey("Revoke one", func() {
+			So(opt.RevokeSession("2", ls[1].Id), ShouldEqual, ErrNotBound)
+			So(serve(router, "/me", phone).Code, ShouldEqual, http.StatusOK)
+
+			So(opt.RevokeSession("1", ls[1].Id), ShouldBeNil)
+			So(serve(router, "/me", phone).Code, ShouldEqual, http.StatusForbidden)
+			So(serve(router, "/me", laptop).Code, ShouldEqual, http.StatusOK)
+
+			ls, err = opt.ListSessions("1")
+			So(err, ShouldBeNil)
+			So(ls, ShouldHaveLength, 1)
+		})
+
+		Convey("Revoke all", func() {
+			So(opt.RevokeUser("1"), ShouldBeNil)
+			So(serve(router, "/me", phone).Code, ShouldEqual, http.StatusForbidden)
+			So(serve(router, "/me", laptop).Code, ShouldEqual, http.StatusForbidden)
+
+			ls, err = opt.ListSessions("1")
+			So(err, ShouldBeNil)
+			So(ls, ShouldBeEmpty)
+		})
+
+		Convey("Regenerate moves the binding", func() {
+			resp := serve(router, "/regenerate", phone)
+			phone = resp.Header().Get("Set-Cookie")
+
+			infos, err := opt.Store.(Indexer).Sessions("1")
+			So(err, ShouldBeNil)
+			So(infos, ShouldHaveLength, 2)
+			for _, info := range infos {
+				So(info.Id, ShouldNotEqual, ls[1].Id)
+			}
+
+			So(opt.RevokeUser("1"), ShouldBeNil)
+			So(serve(router, "/me", phone).Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("Dead session is pruned", func() {
+			So(opt.Store.Del(ls[0].Id), ShouldBeNil)
+
+			ls, err = opt.ListSessions("1")
+			So(err, ShouldBeNil)
+			So(ls, ShouldHaveLength, 1)
+
+			infos, err := opt.Store.(Indexer).Sessions("1")
+			So(err, ShouldBeNil)
+			So(infos, ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("Store without index", t, func() {
+		_, err := newTestOptions().ListSessions("1")
+		So(err, ShouldEqual, ErrIndexUnsupported)
+	})
+}
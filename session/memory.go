@@ -0,0 +1,305 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	_ Store    = &MemoryStore{}
+	_ Toucher  = &MemoryStore{}
+	_ CASStore = &MemoryStore{}
+	_ Locker   = &MemoryStore{}
+	_ Indexer  = &MemoryStore{}
+	_ Scanner  = &MemoryStore{}
+)
+
+// MemoryLockTTL is the expiration of a MemoryStore lock in case it is never released
+var MemoryLockTTL = 30 * time.Second
+
+// memoryItem represents a stored session, Data is shared with the caller.
+type memoryItem struct {
+	container Container
+	expire    time.Time
+}
+
+func (item *memoryItem) isExpired(now time.Time) bool {
+	return !item.expire.IsZero() && now.After(item.expire)
+}
+
+type memoryLock struct {
+	ch   chan struct{}
+	refs int
+	// gen identifies the holder, it's bumped on every release
+	gen uint64
+}
+
+// MemoryStore represents a memory session store implementation, it is
+// suitable for single process and tests.
+type MemoryStore struct {
+	lock   sync.RWMutex
+	items  map[string]*memoryItem
+	users  map[string]map[string]*SessionInfo
+	locks  map[string]*memoryLock
+	maxAge time.Duration
+	gc     *time.Timer
+	closed bool
+}
+
+// NewMemoryStore creates and returns a memory session store, sessions expire
+// after maxAge seconds without access, 0 means never. Close stops its gc.
+func NewMemoryStore(maxAge int64) *MemoryStore {
+	s := &MemoryStore{
+		items:  make(map[string]*memoryItem),
+		users:  make(map[string]map[string]*SessionInfo),
+		locks:  make(map[string]*memoryLock),
+		maxAge: time.Duration(maxAge) * time.Second,
+	}
+
+	if s.maxAge > 0 {
+		s.lock.Lock()
+		s.gc = time.AfterFunc(s.maxAge, s.startGC)
+		s.lock.Unlock()
+	}
+	return s
+}
+
+func (s *MemoryStore) expire() time.Time {
+	if s.maxAge > 0 {
+		return time.Now().Add(s.maxAge)
+	}
+	return time.Time{}
+}
+
+// Get gets value by given key in session.
+func (s *MemoryStore) Get(id string) *Container {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	item, ok := s.items[id]
+	if !ok || item.isExpired(time.Now()) {
+		return nil
+	}
+
+	c := item.container
+	return &c
+}
+
+// Set sets value to given key in session.
+func (s *MemoryStore) Set(id string, container *Container) error {
+	if !container.Changed {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.set(id, container)
+	return nil
+}
+
+func (s *MemoryStore) set(id string, container *Container) {
+	c := *container
+	c.Changed = false
+	s.items[id] = &memoryItem{container: c, expire: s.expire()}
+}
+
+// SetCAS sets value to given key in session if it isn't changed by others.
+func (s *MemoryStore) SetCAS(id string, container *Container) error {
+	if !container.Changed {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var version int64
+	if item, ok := s.items[id]; ok && !item.isExpired(time.Now()) {
+		version = item.container.Version
+	}
+	if version != container.Version {
+		return ErrConflict
+	}
+
+	container.Version++
+	s.set(id, container)
+	return nil
+}
+
+// Touch refreshes the ttl of a session.
+func (s *MemoryStore) Touch(id string) error {
+	if s.maxAge <= 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if item, ok := s.items[id]; ok {
+		item.expire = s.expire()
+	}
+	return nil
+}
+
+// Del deletes a key from session.
+func (s *MemoryStore) Del(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.items, id)
+	return nil
+}
+
+// Flush deletes all sessions and the user index.
+func (s *MemoryStore) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.items = make(map[string]*memoryItem)
+	s.users = make(map[string]map[string]*SessionInfo)
+	return nil
+}
+
+// Lock acquires the lock of a session.
+func (s *MemoryStore) Lock(id string, timeout time.Duration) (func() error, error) {
+	s.lock.Lock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &memoryLock{ch: make(chan struct{}, 1)}
+		s.locks[id] = l
+	}
+	l.refs++
+	s.lock.Unlock()
+
+	// waiters hold a ref, so the lock isn't removed under them
+	release := func() {
+		s.lock.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(s.locks, id)
+		}
+		s.lock.Unlock()
+	}
+
+	select {
+	case l.ch <- struct{}{}:
+		s.lock.Lock()
+		gen := l.gen
+		s.lock.Unlock()
+
+		// free is done once by unlock or the expiration
+		free := func() {
+			s.lock.Lock()
+			if l.gen != gen {
+				s.lock.Unlock()
+				return
+			}
+			l.gen++
+			<-l.ch
+			s.lock.Unlock()
+			release()
+		}
+		timer := time.AfterFunc(MemoryLockTTL, free)
+
+		return func() error {
+			timer.Stop()
+			free()
+			return nil
+		}, nil
+	case <-time.After(timeout):
+		release()
+		return nil, ErrLockTimeout
+	}
+}
+
+// Scan lists live sessions order by id.
+func (s *MemoryStore) Scan(cursor string, limit int) ([]string, string, error) {
+	s.lock.RLock()
+	now := time.Now()
+	ids := make([]string, 0, len(s.items))
+	for id, item := range s.items {
+		if id > cursor && !item.isExpired(now) {
+			ids = append(ids, id)
+		}
+	}
+	s.lock.RUnlock()
+
+	sort.Strings(ids)
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+		return ids, ids[limit-1], nil
+	}
+	return ids, "", nil
+}
+
+// Bind adds the session to the user's index.
+func (s *MemoryStore) Bind(userId string, info *SessionInfo) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.users[userId] == nil {
+		s.users[userId] = make(map[string]*SessionInfo)
+	}
+	tmp := *info
+	s.users[userId][info.Id] = &tmp
+	return nil
+}
+
+// Unbind removes the session from the user's index.
+func (s *MemoryStore) Unbind(userId, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.users[userId], id)
+	if len(s.users[userId]) == 0 {
+		delete(s.users, userId)
+	}
+	return nil
+}
+
+// Sessions returns the indexed sessions of a user.
+func (s *MemoryStore) Sessions(userId string) ([]*SessionInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ls := make([]*SessionInfo, 0, len(s.users[userId]))
+	for _, info := range s.users[userId] {
+		tmp := *info
+		ls = append(ls, &tmp)
+	}
+	return ls, nil
+}
+
+func (s *MemoryStore) startGC() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for id, item := range s.items {
+		if item.isExpired(now) {
+			delete(s.items, id)
+		}
+	}
+
+	if !s.closed {
+		s.gc = time.AfterFunc(s.maxAge, s.startGC)
+	}
+}
+
+// Close stops the gc of the store.
+func (s *MemoryStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	if s.gc != nil {
+		s.gc.Stop()
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MemoryStore(t *testing.T) {
+	Convey("Memory store", t, func() {
+		store := NewMemoryStore(1)
+
+		Convey("Basic operation", func() {
+			So(store.Get("a"), ShouldBeNil)
+			So(store.Set("a", &Container{}), ShouldBeNil)
+			So(store.Get("a"), ShouldBeNil)
+
+			So(store.Set("a", &Container{Data: "a", Changed: true}), ShouldBeNil)
+			So(store.Get("a").Data, ShouldEqual, "a")
+			So(store.Get("a").Changed, ShouldBeFalse)
+
+			So(store.Del("a"), ShouldBeNil)
+			So(store.Get("a"), ShouldBeNil)
+
+			So(store.Set("b", &Container{Data: "b", Changed: true}), ShouldBeNil)
+			So(store.Flush(), ShouldBeNil)
+			So(store.Get("b"), ShouldBeNil)
+		})
+
+		Convey("Expire and touch", func() {
+			So(store.Set("a", &Container{Data: "a", Changed: true}), ShouldBeNil)
+			time.Sleep(600 * time.Millisecond)
+			So(store.Touch("a"), ShouldBeNil)
+			time.Sleep(600 * time.Millisecond)
+			So(store.Get("a"), ShouldNotBeNil)
+
+			time.Sleep(1100 * time.Millisecond)
+			So(store.Get("a"), ShouldBeNil)
+		})
+
+		Convey("CAS", func() {
+			c := &Container{Data: "a", Changed: true}
+			So(store.SetCAS("a", c), ShouldBeNil)
+			So(c.Version, ShouldEqual, 1)
+			So(store.SetCAS("a", &Container{Data: "b", Changed: true}), ShouldEqual, ErrConflict)
+			So(store.SetCAS("a", c), ShouldBeNil)
+			So(store.Get("a").Version, ShouldEqual, 2)
+		})
+
+		Convey("Close stops the gc", func() {
+			So(store.Close(), ShouldBeNil)
+			So(store.Set("a", &Container{Data: "a", Changed: true}), ShouldBeNil)
+			time.Sleep(2100 * time.Millisecond)
+
+			store.lock.RLock()
+			_, ok := store.items["a"]
+			store.lock.RUnlock()
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Lock", func() {
+			unlock, err := store.Lock("a", time.Second)
+			So(err, ShouldBeNil)
+			_, err = store.Lock("a", 10*time.Millisecond)
+			So(err, ShouldEqual, ErrLockTimeout)
+			So(unlock(), ShouldBeNil)
+
+			unlock, err = store.Lock("a", 10*time.Millisecond)
+			So(err, ShouldBeNil)
+			So(unlock(), ShouldBeNil)
+			So(store.locks, ShouldBeEmpty)
+		})
+
+		Convey("Lock expires", func() {
+			ttl := MemoryLockTTL
+			MemoryLockTTL = 50 * time.Millisecond
+			defer func() { MemoryLockTTL = ttl }()
+
+			unlock, err := store.Lock("a", time.Second)
+			So(err, ShouldBeNil)
+
+			// the expired holder doesn't release the new one
+			unlock2, err := store.Lock("a", time.Second)
+			So(err, ShouldBeNil)
+			So(unlock(), ShouldBeNil)
+			_, err = store.Lock("a", 10*time.Millisecond)
+			So(err, ShouldEqual, ErrLockTimeout)
+
+			So(unlock2(), ShouldBeNil)
+			So(store.locks, ShouldBeEmpty)
+		})
+	})
+}
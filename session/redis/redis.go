@@ -0,0 +1,277 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package redisstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/go-redis/redis"
+	"github.com/meilihao/water-contrib/session"
+)
+
+var (
+	_ session.Store    = &RedisStore{}
+	_ session.Toucher  = &RedisStore{}
+	_ session.CASStore = &RedisStore{}
+	_ session.Locker   = &RedisStore{}
+	_ session.Scanner  = &RedisStore{}
+)
+
+var (
+	// LockTTL is the expiration of a session lock in case it is never released
+	LockTTL = 30 * time.Second
+	// lockRetry is the interval to retry acquiring a lock
+	lockRetry = 10 * time.Millisecond
+
+	// deletes the lock only if it's still held by the token
+	unlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`
+)
+
+// RedisStore represents a redis session store implementation.
+type RedisStore struct {
+	prefix string
+	client *redis.Client
+	maxAge int64
+
+	serializer session.Serializer
+}
+
+// New creates and returns a redis session store.
+func New(config string) (*RedisStore, error) {
+	js, err := simplejson.NewJson([]byte(config))
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     js.Get("Redis").Get("Addr").MustString("127.0.0.1:6379"),
+		Password: js.Get("Redis").Get("Password").MustString(""),
+		DB:       js.Get("Redis").Get("DB").MustInt(0),
+		PoolSize: js.Get("Redis").Get("PoolSize").MustInt(0),
+	})
+
+	s, err := NewByInstance(client, js.Get("Prefix").MustString("sredis_"), js.Get("MaxAge").MustInt64(0))
+	if err != nil {
+		return nil, err
+	}
+
+	if s.serializer, err = session.GetSerializer(js.Get("Serializer").MustString("")); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewByInstance creates and returns a redis session store by an existing client.
+func NewByInstance(client *redis.Client, prefix string, maxAge int64) (*RedisStore, error) {
+	if client == nil {
+		return nil, errors.New("session : redis error: nil client.")
+	}
+
+	if err := client.Ping().Err(); err != nil {
+		return nil, errors.New("session : redis error: wrong config.")
+	}
+
+	serializer, err := session.GetSerializer("")
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisStore{
+		prefix:     prefix,
+		client:     client,
+		maxAge:     maxAge,
+		serializer: serializer,
+	}, nil
+}
+
+// SetSerializer changes the serializer, default is session.DefaultSerializerName.
+func (s *RedisStore) SetSerializer(serializer session.Serializer) {
+	s.serializer = serializer
+}
+
+func (s *RedisStore) ttl() time.Duration {
+	return time.Duration(s.maxAge) * time.Second
+}
+
+// Get gets value by given key in session.
+func (s *RedisStore) Get(id string) *session.Container {
+	bs, err := s.client.Get(s.prefix + id).Bytes()
+	if err != nil {
+		return nil
+	}
+	if len(bs) == 0 {
+		return nil
+	}
+
+	container, err := session.DecodeContainer(s.serializer, bs)
+	if err != nil {
+		return nil
+	}
+
+	return container
+}
+
+// Set sets value to given key in session.
+func (s *RedisStore) Set(id string, container *session.Container) error {
+	if !container.Changed {
+		return nil
+	}
+
+	bs, err := session.EncodeContainer(s.serializer, container)
+	if err != nil {
+		return err
+	}
+
+	// ttl 0 means no expiration
+	return s.client.Set(s.prefix+id, bs, s.ttl()).Err()
+}
+
+// Touch refreshes the ttl of a session.
+func (s *RedisStore) Touch(id string) error {
+	if s.maxAge <= 0 {
+		return nil
+	}
+	return s.client.Expire(s.prefix+id, s.ttl()).Err()
+}
+
+// Del deletes a key from session.
+func (s *RedisStore) Del(id string) error {
+	return s.client.Del(s.prefix + id).Err()
+}
+
+// Flush deletes all sessions with the store's prefix.
+func (s *RedisStore) Flush() error {
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(cursor, s.prefix+"*", 100).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err = s.client.Del(keys...).Err(); err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// Scan lists sessions by redis SCAN whose cursor is a number, locks sharing
+// the prefix are skipped.
+func (s *RedisStore) Scan(cursor string, limit int) ([]string, string, error) {
+	var c uint64
+	if cursor != "" {
+		var err error
+		if c, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", err
+		}
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+
+	keys, next, err := s.client.Scan(c, s.prefix+"*", int64(limit)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if id := strings.TrimPrefix(key, s.prefix); !session.IsInternalKey(id) {
+			ids = append(ids, id)
+		}
+	}
+
+	if next == 0 {
+		return ids, "", nil
+	}
+	return ids, strconv.FormatUint(next, 10), nil
+}
+
+// SetCAS sets value to given key in session if it isn't changed by others.
+func (s *RedisStore) SetCAS(id string, container *session.Container) error {
+	if !container.Changed {
+		return nil
+	}
+
+	next := *container
+	next.Version++
+	bs, err := session.EncodeContainer(s.serializer, &next)
+	if err != nil {
+		return err
+	}
+
+	key := s.prefix + id
+	err = s.client.Watch(func(tx *redis.Tx) error {
+		var version int64
+
+		old, err := tx.Get(key).Bytes()
+		switch err {
+		case nil:
+			if version, err = session.PeekVersion(old); err != nil {
+				return err
+			}
+		case redis.Nil:
+		default:
+			return err
+		}
+
+		if version != container.Version {
+			return session.ErrConflict
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, bs, s.ttl())
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return session.ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	container.Version = next.Version
+	return nil
+}
+
+// Lock acquires the lock of a session.
+func (s *RedisStore) Lock(id string, timeout time.Duration) (func() error, error) {
+	key := s.prefix + "lock:" + id
+	token := hex.EncodeToString(session.GenRandKey(16))
+	deadline := time.Now().Add(timeout)
+
+	for {
+		ok, err := s.client.SetNX(key, token, LockTTL).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() error {
+				return s.client.Eval(unlockScript, []string{key}, token).Err()
+			}, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, session.ErrLockTimeout
+		}
+		time.Sleep(lockRetry)
+	}
+}
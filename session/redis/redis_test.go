@@ -0,0 +1,146 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package redisstore
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/session"
+	"github.com/meilihao/water-contrib/session/sessiontest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var manager *session.Options
+
+type Sessdata struct {
+	UserName string
+}
+
+func init() {
+	log.SetFlags(log.Lshortfile)
+
+	session.RegisterType(&Sessdata{})
+
+	// in-process stand-in of redis server
+	mr, err := miniredis.Run()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	manager = new(session.Options)
+	manager.Generator = session.NewSha1Generator("sha1")
+	manager.Tracker = session.NewCookieTracker("session", 0, false, "/", "")
+	manager.OnSessionNew = func(s *session.Session) {
+		fmt.Println("OnSessionNew")
+	}
+	manager.OnSessionRelease = func(s *session.Session) {
+		fmt.Println("OnSessionRelease")
+	}
+	store, err := New(fmt.Sprintf(`
+{
+    "Redis":{
+        "Addr":"%s"
+    },
+    "Prefix":"sredis_",
+    "MaxAge":0
+}`, mr.Addr()))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	manager.Store = store
+}
+
+func Test_Session(t *testing.T) {
+	Convey("Basic operation", t, func() {
+		router := water.Classic()
+		router.Before(session.New(manager))
+		router.Get("/", func(ctx *water.Context) {
+			sess := session.Get(ctx)
+
+			sess.Container.Data = &Sessdata{UserName: "chen"}
+			sess.Container.Changed = true
+		})
+		router.Get("/get", func(ctx *water.Context) {
+			sess := session.Get(ctx)
+			So(sess.Id, ShouldNotBeEmpty)
+
+			sd, ok := sess.Container.Data.(*Sessdata)
+			So(ok, ShouldBeTrue)
+			So(sd.UserName, ShouldEqual, "chen")
+
+			So(sess.Del(sess.Id), ShouldBeNil)
+
+			sc := sess.Get(sess.Id)
+			So(sc.Data, ShouldBeNil)
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/", nil)
+		So(err, ShouldBeNil)
+		router.ServeHTTP(resp, req)
+
+		cookie := resp.Header().Get("Set-Cookie")
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", "/get", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		router.ServeHTTP(resp, req)
+	})
+
+	Convey("Flush", t, func() {
+		store := manager.Store
+		So(store.Set("a", &session.Container{Data: "a", Changed: true}), ShouldBeNil)
+		So(store.Set("b", &session.Container{Data: "b", Changed: true}), ShouldBeNil)
+		So(store.Get("a"), ShouldNotBeNil)
+
+		So(store.Flush(), ShouldBeNil)
+		So(store.Get("a"), ShouldBeNil)
+		So(store.Get("b"), ShouldBeNil)
+	})
+
+	Convey("CAS and lock", t, func() {
+		store := manager.Store.(*RedisStore)
+
+		c := &session.Container{Data: &Sessdata{UserName: "chen"}, Changed: true}
+		So(store.SetCAS("cas", c), ShouldBeNil)
+		So(c.Version, ShouldEqual, 1)
+		So(store.Get("cas").Version, ShouldEqual, 1)
+
+		stale := &session.Container{Data: &Sessdata{UserName: "li"}, Changed: true}
+		So(store.SetCAS("cas", stale), ShouldEqual, session.ErrConflict)
+
+		So(store.SetCAS("cas", c), ShouldBeNil)
+		So(c.Version, ShouldEqual, 2)
+		So(store.Del("cas"), ShouldBeNil)
+
+		unlock, err := store.Lock("cas", time.Second)
+		So(err, ShouldBeNil)
+		_, err = store.Lock("cas", 50*time.Millisecond)
+		So(err, ShouldEqual, session.ErrLockTimeout)
+		So(unlock(), ShouldBeNil)
+
+		unlock, err = store.Lock("cas", 50*time.Millisecond)
+		So(err, ShouldBeNil)
+		So(unlock(), ShouldBeNil)
+	})
+}
+
+func Test_Conformance(t *testing.T) {
+	// miniredis doesn't expire keys by wall clock, so expiry is skipped
+	sessiontest.TestStore(t, func(t *testing.T) session.Store {
+		if err := manager.Store.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return manager.Store
+	}, sessiontest.Config{})
+}
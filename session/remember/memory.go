@@ -0,0 +1,75 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remember
+
+import (
+	"bytes"
+	"sync"
+)
+
+var _ Store = &MemoryStore{}
+
+// MemoryStore represents a memory token store implementation, it is
+// suitable for single process and tests.
+type MemoryStore struct {
+	lock   sync.RWMutex
+	tokens map[string]Token
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens: make(map[string]Token),
+	}
+}
+
+func (s *MemoryStore) Get(selector string) (*Token, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	t, ok := s.tokens[selector]
+	if !ok {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (s *MemoryStore) Set(t *Token) error {
+	s.lock.Lock()
+	s.tokens[t.Selector] = *t
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Rotate(t *Token, oldHash []byte) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, ok := s.tokens[t.Selector]
+	if !ok || !bytes.Equal(old.Hash, oldHash) {
+		return false, nil
+	}
+	s.tokens[t.Selector] = *t
+	return true, nil
+}
+
+func (s *MemoryStore) Del(selector string) error {
+	s.lock.Lock()
+	delete(s.tokens, selector)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) DelUser(userId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for selector, t := range s.tokens {
+		if t.UserId == userId {
+			delete(s.tokens, selector)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package remember implements "remember me" logins by selector/validator
+// tokens, it restores a fresh session.Session for a remembered user after the
+// short-lived one is expired.
+package remember
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/session"
+)
+
+// ErrRandom is returned when crypto/rand fails.
+var ErrRandom = errors.New("remember : random error")
+
+const (
+	selectorLen  = 12
+	validatorLen = 32
+)
+
+// Token is a remember-me token, only the hash of its validator is stored.
+type Token struct {
+	Selector string
+	UserId   string
+	Hash     []byte
+	// PrevHash is the hash replaced at Rotated, it's accepted in Options.Grace
+	// for parallel requests sending the old cookie
+	PrevHash []byte
+	Rotated  time.Time
+	Expires  time.Time
+}
+
+// Store keeps tokens by selector.
+type Store interface {
+	// Get returns nil without error when the token doesn't exist
+	Get(selector string) (*Token, error)
+	Set(t *Token) error
+	// Rotate sets t only if the stored token's Hash is still oldHash, it
+	// returns false when a parallel request rotated the token first
+	Rotate(t *Token, oldHash []byte) (bool, error)
+	Del(selector string) error
+	// DelUser deletes all tokens of a user
+	DelUser(userId string) error
+}
+
+type Options struct {
+	Store Store
+	// CookieName default is "remember"
+	CookieName string
+	Path       string
+	Domain     string
+	Secure     bool
+	// MaxAge is the lifetime of a token, default is 30 days
+	MaxAge time.Duration
+	// Grace accepts the previous validator of a token for a while, default is 10 seconds
+	Grace time.Duration
+	// OnLogin fills the fresh session of a remembered user, it's required
+	OnLogin func(ctx *water.Context, sess *session.Session, userId string)
+	// OnTheft is called after a used validator is presented again, all tokens
+	// of the user are deleted then
+	OnTheft func(ctx *water.Context, userId string)
+}
+
+func (opt *Options) init() {
+	if opt.CookieName == "" {
+		opt.CookieName = "remember"
+	}
+	if opt.Path == "" {
+		opt.Path = "/"
+	}
+	if opt.MaxAge <= 0 {
+		opt.MaxAge = 30 * 24 * time.Hour
+	}
+	if opt.Grace <= 0 {
+		opt.Grace = 10 * time.Second
+	}
+}
+
+// New returns the middleware logging in remembered users, it must be used
+// after session.New.
+func New(opt *Options) water.HandlerFunc {
+	opt.init()
+	if opt.Store == nil || opt.OnLogin == nil {
+		panic("remember : need Store and OnLogin")
+	}
+
+	return func(ctx *water.Context) {
+		if cookie, err := ctx.Req.Cookie(opt.CookieName); err == nil && cookie.Value != "" {
+			// session is loaded only for remembered clients
+			if sess := session.Get(ctx); sess != nil && sess.IsNew() {
+				opt.login(ctx, sess, cookie.Value)
+			}
+		}
+
+		ctx.Next()
+	}
+}
+
+func (opt *Options) login(ctx *water.Context, sess *session.Session, value string) {
+	selector, validator, ok := parse(value)
+	if !ok {
+		opt.clear(ctx)
+		return
+	}
+
+	t, err := opt.Store.Get(selector)
+	if err != nil {
+		log.Println("remember : error(1):" + err.Error())
+		return
+	}
+	if t == nil {
+		opt.clear(ctx)
+		return
+	}
+
+	now := time.Now()
+	if now.After(t.Expires) {
+		if err = opt.Store.Del(selector); err != nil {
+			log.Println("remember : error(2):" + err.Error())
+		}
+		opt.clear(ctx)
+		return
+	}
+
+	hash := hashValidator(validator)
+	if subtle.ConstantTimeCompare(hash, t.Hash) == 1 {
+		rotated, err := opt.rotate(ctx, t)
+		if err != nil {
+			log.Println("remember : error(3):" + err.Error())
+			return
+		}
+		if rotated {
+			opt.OnLogin(ctx, sess, t.UserId)
+			return
+		}
+
+		// a parallel request rotated it first, so the grace applies
+		if t, err = opt.Store.Get(selector); err != nil {
+			log.Println("remember : error(5):" + err.Error())
+			return
+		}
+		if t == nil {
+			opt.clear(ctx)
+			return
+		}
+	}
+
+	if t.PrevHash != nil && now.Sub(t.Rotated) < opt.Grace && subtle.ConstantTimeCompare(hash, t.PrevHash) == 1 {
+		// a parallel request rotated it, the client gets the new cookie from that one
+		opt.OnLogin(ctx, sess, t.UserId)
+		return
+	}
+
+	// the selector is known but the validator is used or forged
+	if err = opt.Store.DelUser(t.UserId); err != nil {
+		log.Println("remember : error(4):" + err.Error())
+	}
+	opt.clear(ctx)
+	if opt.OnTheft != nil {
+		opt.OnTheft(ctx, t.UserId)
+	}
+}
+
+// rotate replaces the validator of t and sends the new cookie, it returns
+// false if a parallel request rotated t first.
+func (opt *Options) rotate(ctx *water.Context, t *Token) (bool, error) {
+	bs := session.GenRandKey(validatorLen)
+	if len(bs) == 0 {
+		return false, ErrRandom
+	}
+	validator := encode(bs)
+
+	t.PrevHash = t.Hash
+	t.Hash = hashValidator(validator)
+	t.Rotated = time.Now()
+	ok, err := opt.Store.Rotate(t, t.PrevHash)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	opt.setCookie(ctx, t.Selector+":"+validator, int(time.Until(t.Expires)/time.Second))
+	return true, nil
+}
+
+// Issue creates a token for the user after a login with "remember me".
+func (opt *Options) Issue(ctx *water.Context, userId string) error {
+	opt.init()
+
+	selector := session.GenRandKey(selectorLen)
+	bs := session.GenRandKey(validatorLen)
+	if len(selector) == 0 || len(bs) == 0 {
+		return ErrRandom
+	}
+	validator := encode(bs)
+
+	t := &Token{
+		Selector: encode(selector),
+		UserId:   userId,
+		Hash:     hashValidator(validator),
+		Expires:  time.Now().Add(opt.MaxAge),
+	}
+	if err := opt.Store.Set(t); err != nil {
+		return err
+	}
+
+	opt.setCookie(ctx, t.Selector+":"+validator, int(opt.MaxAge/time.Second))
+	return nil
+}
+
+// Forget deletes the token of the request and clears the cookie, e.g. logout.
+func (opt *Options) Forget(ctx *water.Context) error {
+	opt.init()
+	defer opt.clear(ctx)
+
+	cookie, err := ctx.Req.Cookie(opt.CookieName)
+	if err != nil {
+		return nil
+	}
+	selector, _, ok := parse(cookie.Value)
+	if !ok {
+		return nil
+	}
+	return opt.Store.Del(selector)
+}
+
+// ForgetUser deletes all tokens of the user, e.g. the password is changed.
+func (opt *Options) ForgetUser(userId string) error {
+	return opt.Store.DelUser(userId)
+}
+
+func (opt *Options) setCookie(ctx *water.Context, value string, maxAge int) {
+	http.SetCookie(ctx.ResponseWriter, &http.Cookie{
+		Name:     opt.CookieName,
+		Value:    value,
+		Path:     opt.Path,
+		Domain:   opt.Domain,
+		MaxAge:   maxAge,
+		Secure:   opt.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (opt *Options) clear(ctx *water.Context) {
+	opt.setCookie(ctx, "", -1)
+}
+
+func parse(value string) (selector, validator string, ok bool) {
+	i := strings.IndexByte(value, ':')
+	if i <= 0 {
+		return "", "", false
+	}
+
+	selector, validator = value[:i], value[i+1:]
+	if len(selector) != base64.RawURLEncoding.EncodedLen(selectorLen) ||
+		len(validator) != base64.RawURLEncoding.EncodedLen(validatorLen) {
+		return "", "", false
+	}
+	return selector, validator, true
+}
+
+func encode(bs []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// hashValidator hashes the encoded validator, the token has enough entropy
+// for a plain sha256.
+func hashValidator(validator string) []byte {
+	sum := sha256.Sum256([]byte(validator))
+	return sum[:]
+}
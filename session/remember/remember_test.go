@@ -0,0 +1,170 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remember
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/session"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func cookies(resp *httptest.ResponseRecorder) map[string]*http.Cookie {
+	m := make(map[string]*http.Cookie)
+	for _, c := range (&http.Response{Header: resp.Header()}).Cookies() {
+		m[c.Name] = c
+	}
+	return m
+}
+
+// staleStore returns stale once, like a Get racing a parallel rotation.
+type staleStore struct {
+	*MemoryStore
+	stale *Token
+}
+
+func (s *staleStore) Get(selector string) (*Token, error) {
+	if t := s.stale; t != nil {
+		s.stale = nil
+		return t, nil
+	}
+	return s.MemoryStore.Get(selector)
+}
+
+func Test_Remember(t *testing.T) {
+	Convey("Remember me", t, func() {
+		store := NewMemoryStore()
+		racy := &staleStore{MemoryStore: store}
+		var loggedIn, stolen string
+
+		opt := &Options{
+			Store: racy,
+			OnLogin: func(ctx *water.Context, sess *session.Session, userId string) {
+				loggedIn = userId
+				sess.Data = userId
+			},
+			OnTheft: func(ctx *water.Context, userId string) {
+				stolen = userId
+			},
+		}
+
+		router := water.NewRouter()
+		router.Before(session.New(&session.Options{
+			Store:     session.NewMemoryStore(0),
+			Generator: session.NewSha256Generator("0123456789abcdef"),
+			Tracker:   session.NewCookieTracker("session", 0, false, "/", ""),
+		}))
+		router.Before(New(opt))
+		router.Get("/login", func(ctx *water.Context) {
+			session.Get(ctx).Data = "chen"
+			So(opt.Issue(ctx, "chen"), ShouldBeNil)
+		})
+		router.Get("/", func(ctx *water.Context) {})
+		router.Get("/logout", func(ctx *water.Context) {
+			So(opt.Forget(ctx), ShouldBeNil)
+		})
+
+		serve := func(path string, cs ...*http.Cookie) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", path, nil)
+			for _, c := range cs {
+				req.AddCookie(c)
+			}
+			router.ServeHTTP(resp, req)
+			return resp
+		}
+
+		issued := cookies(serve("/login"))["remember"]
+		So(issued, ShouldNotBeNil)
+		So(issued.MaxAge, ShouldEqual, 30*24*3600)
+		So(issued.HttpOnly, ShouldBeTrue)
+
+		// the validator isn't stored
+		selector, validator, ok := parse(issued.Value)
+		So(ok, ShouldBeTrue)
+		token, _ := store.Get(selector)
+		So(string(token.Hash), ShouldNotContainSubstring, validator)
+
+		// session is expired, only the remember cookie is sent
+		rotated := cookies(serve("/", issued))
+		So(loggedIn, ShouldEqual, "chen")
+		So(rotated["session"], ShouldNotBeNil)
+		So(rotated["remember"].Value, ShouldNotEqual, issued.Value)
+		So(rotated["remember"].Value, ShouldStartWith, selector+":")
+
+		Convey("Live session isn't touched", func() {
+			loggedIn = ""
+			resp := serve("/", rotated["session"], rotated["remember"])
+			So(loggedIn, ShouldBeEmpty)
+			So(cookies(resp)["remember"], ShouldBeNil)
+		})
+
+		Convey("Old validator in grace", func() {
+			loggedIn = ""
+			resp := serve("/", issued)
+			So(loggedIn, ShouldEqual, "chen")
+			So(cookies(resp)["remember"], ShouldBeNil)
+		})
+
+		Convey("Parallel rotation isn't theft", func() {
+			// the request read the token before it was rotated
+			racy.stale = token
+			loggedIn = ""
+
+			resp := serve("/", issued)
+			So(stolen, ShouldBeEmpty)
+			So(loggedIn, ShouldEqual, "chen")
+			So(cookies(resp)["remember"], ShouldBeNil)
+
+			// the cookie of the winner is still valid
+			loggedIn = ""
+			serve("/", rotated["remember"])
+			So(stolen, ShouldBeEmpty)
+			So(loggedIn, ShouldEqual, "chen")
+		})
+
+		Convey("Replayed validator is theft", func() {
+			opt.Grace = time.Nanosecond
+			loggedIn = ""
+
+			resp := serve("/", issued)
+			So(stolen, ShouldEqual, "chen")
+			So(loggedIn, ShouldBeEmpty)
+			So(cookies(resp)["remember"].MaxAge, ShouldBeLessThan, 0)
+
+			// all tokens of the user are deleted
+			token, _ := store.Get(selector)
+			So(token, ShouldBeNil)
+			serve("/", rotated["remember"])
+			So(loggedIn, ShouldBeEmpty)
+		})
+
+		Convey("Forget", func() {
+			serve("/logout", rotated["remember"])
+			token, _ := store.Get(selector)
+			So(token, ShouldBeNil)
+		})
+
+		Convey("Expired or malformed token", func() {
+			token, _ := store.Get(selector)
+			token.Expires = time.Now().Add(-time.Second)
+			store.Set(token)
+
+			loggedIn = ""
+			serve("/", rotated["remember"])
+			So(loggedIn, ShouldBeEmpty)
+			token, _ = store.Get(selector)
+			So(token, ShouldBeNil)
+
+			serve("/", &http.Cookie{Name: "remember", Value: "a:b"})
+			So(loggedIn, ShouldBeEmpty)
+		})
+	})
+}
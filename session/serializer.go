@@ -0,0 +1,544 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	// SerializerVersion is the first byte of every encoded payload.
+	// Bump it when the layout changes, so old payloads can be migrated.
+	SerializerVersion byte = 1
+	// ContainerVersion is the first byte of a stored container.
+	ContainerVersion byte = 4
+
+	// v1: version + CreateTime + LastTime
+	containerHeaderLenV1 = 1 + 8 + 8
+	// v2: v1 + Container.Version
+	containerHeaderLenV2 = containerHeaderLenV1 + 8
+	// v3: v2 + len-prefixed Container.ClientNet + len-prefixed Container.UserAgent
+	// v4: v3 + len-prefixed Container.UserId
+)
+
+var (
+	ErrEmptyPayload       = errors.New("session : empty payload")
+	ErrSerializerVersion  = errors.New("session : unknown serializer version")
+	ErrContainerVersion   = errors.New("session : unknown container version")
+	ErrUnregisteredType   = errors.New("session : unregistered type")
+	DefaultSerializerName = "gob"
+)
+
+// Serializer encodes session data for stores.
+type Serializer interface {
+	Encode(data interface{}) ([]byte, error)
+	Decode(bs []byte) (interface{}, error)
+}
+
+var (
+	serializers = make(map[string]Serializer)
+
+	typeLock sync.RWMutex
+	types    = make(map[string]reflect.Type)
+)
+
+// RegisterSerializer registers a serializer by name.
+func RegisterSerializer(name string, s Serializer) {
+	if s == nil {
+		panic("session: cannot register serializer with nil value")
+	}
+	if _, dup := serializers[name]; dup {
+		panic(fmt.Errorf("session: cannot register serializer '%s' twice", name))
+	}
+	serializers[name] = s
+}
+
+// GetSerializer returns the serializer by name, "" means DefaultSerializerName.
+func GetSerializer(name string) (Serializer, error) {
+	if name == "" {
+		name = DefaultSerializerName
+	}
+
+	s, ok := serializers[name]
+	if !ok {
+		return nil, fmt.Errorf("session : unknown serializer '%s'(forgot to import?)", name)
+	}
+	return s, nil
+}
+
+// RegisterType records the concrete type of session data, it should be called
+// once at init time for every type stored in Container.Data.
+// Pointers are decoded as pointers, values as values, a type can be registered
+// either as pointer or as value(gob rejects both).
+func RegisterType(value interface{}) {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		panic("session: cannot register nil type")
+	}
+
+	typeLock.Lock()
+	types[typeName(t)] = t
+	typeLock.Unlock()
+
+	gob.Register(value)
+	if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+		registerLegacy(t.Elem())
+	}
+}
+
+func typeName(t reflect.Type) string {
+	star := ""
+	if t.Kind() == reflect.Ptr {
+		star = "*"
+		t = t.Elem()
+	}
+	if t.Name() == "" || t.PkgPath() == "" {
+		return star + t.String()
+	}
+	return star + t.PkgPath() + "." + t.Name()
+}
+
+// lookupType returns the registered type of value, its name is stored in payload.
+func lookupType(value interface{}) (string, error) {
+	name := typeName(reflect.TypeOf(value))
+
+	typeLock.RLock()
+	_, ok := types[name]
+	typeLock.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnregisteredType, name)
+	}
+	return name, nil
+}
+
+func newOfType(name string) (reflect.Value, error) {
+	typeLock.RLock()
+	t, ok := types[name]
+	typeLock.RUnlock()
+
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("%w: %s", ErrUnregisteredType, name)
+	}
+	return reflect.New(t), nil
+}
+
+func withVersion(body []byte) []byte {
+	return append([]byte{SerializerVersion}, body...)
+}
+
+func stripVersion(bs []byte) ([]byte, error) {
+	if len(bs) == 0 {
+		return nil, ErrEmptyPayload
+	}
+	if bs[0] != SerializerVersion {
+		return nil, ErrSerializerVersion
+	}
+	return bs[1:], nil
+}
+
+// EncodeContainer encodes the container with its metadata for stores,
+// Data is encoded by s.
+func EncodeContainer(s Serializer, c *Container) ([]byte, error) {
+	bs := make([]byte, containerHeaderLenV2, containerHeaderLenV2+6+len(c.ClientNet)+len(c.UserAgent)+len(c.UserId))
+	bs[0] = ContainerVersion
+	binary.BigEndian.PutUint64(bs[1:9], uint64(unixNano(c.CreateTime)))
+	binary.BigEndian.PutUint64(bs[9:17], uint64(unixNano(c.LastTime)))
+	binary.BigEndian.PutUint64(bs[17:25], uint64(c.Version))
+	bs = appendString(bs, c.ClientNet)
+	bs = appendString(bs, c.UserAgent)
+	bs = appendString(bs, c.UserId)
+
+	if c.Data == nil {
+		return bs, nil
+	}
+
+	data, err := s.Encode(c.Data)
+	if err != nil {
+		return nil, err
+	}
+	return append(bs, data...), nil
+}
+
+// headerLen returns the header length of a stored container by its version.
+func headerLen(bs []byte) (int, error) {
+	if len(bs) == 0 {
+		return 0, ErrEmptyPayload
+	}
+
+	n := 0
+	switch bs[0] {
+	case 1:
+		n = containerHeaderLenV1
+	case 2:
+		n = containerHeaderLenV2
+	case 3, ContainerVersion:
+		n = containerHeaderLenV2
+		strs := 2
+		if bs[0] == ContainerVersion {
+			strs = 3
+		}
+		for i := 0; i < strs; i++ {
+			_, next, ok := readString(bs, n)
+			if !ok {
+				return 0, ErrContainerVersion
+			}
+			n = next
+		}
+	default:
+		return 0, ErrContainerVersion
+	}
+	if len(bs) < n {
+		return 0, ErrContainerVersion
+	}
+	return n, nil
+}
+
+// appendString appends s with a 2 bytes length, longer s is truncated.
+func appendString(bs []byte, s string) []byte {
+	if len(s) > 0xffff {
+		s = s[:0xffff]
+	}
+
+	bs = append(bs, byte(len(s)>>8), byte(len(s)))
+	return append(bs, s...)
+}
+
+// readString reads a string appended at offset i by appendString.
+func readString(bs []byte, i int) (string, int, bool) {
+	if len(bs) < i+2 {
+		return "", 0, false
+	}
+	n := int(binary.BigEndian.Uint16(bs[i : i+2]))
+	i += 2
+	if len(bs) < i+n {
+		return "", 0, false
+	}
+	return string(bs[i : i+n]), i + n, true
+}
+
+// PeekVersion returns Container.Version of a stored container without decoding Data.
+func PeekVersion(bs []byte) (int64, error) {
+	if isLegacy(bs) {
+		return 0, nil
+	}
+	if _, err := headerLen(bs); err != nil {
+		return 0, err
+	}
+	if bs[0] == 1 {
+		return 0, nil
+	}
+	return int64(binary.BigEndian.Uint64(bs[17:25])), nil
+}
+
+// DecodeContainer decodes the payload encoded by EncodeContainer, or a
+// payload of the baseline stores, see decodeLegacy.
+func DecodeContainer(s Serializer, bs []byte) (*Container, error) {
+	if isLegacy(bs) {
+		return decodeLegacy(bs)
+	}
+
+	n, err := headerLen(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Container{
+		CreateTime: fromUnixNano(int64(binary.BigEndian.Uint64(bs[1:9]))),
+		LastTime:   fromUnixNano(int64(binary.BigEndian.Uint64(bs[9:17]))),
+	}
+	if bs[0] != 1 {
+		c.Version = int64(binary.BigEndian.Uint64(bs[17:25]))
+	}
+	if bs[0] >= 3 {
+		i := containerHeaderLenV2
+		c.ClientNet, i, _ = readString(bs, i)
+		c.UserAgent, i, _ = readString(bs, i)
+		if bs[0] == ContainerVersion {
+			c.UserId, _, _ = readString(bs, i)
+		}
+	}
+
+	if len(bs) > n {
+		data, err := s.Decode(bs[n:])
+		if err != nil {
+			return nil, err
+		}
+		c.Data = data
+	}
+	return c, nil
+}
+
+var (
+	legacyLock  sync.RWMutex
+	legacyTypes = make(map[reflect.Type]reflect.Type)
+)
+
+// isLegacy reports whether bs is stored by the baseline stores, i.e. a bare
+// gob stream, whose first byte is a message length and never a container
+// version.
+func isLegacy(bs []byte) bool {
+	if len(bs) == 0 {
+		return false
+	}
+
+	switch bs[0] {
+	case 1, 2, 3, ContainerVersion:
+		return false
+	}
+	return true
+}
+
+// decodeLegacy decodes the gob of Container.Data stored by the baseline
+// stores, which had no metadata, so the timeouts start now. The container is
+// Changed, so it's stored in the current format after the request.
+// The baseline stored struct data by pointer and registered the struct by
+// value, so a struct is returned as pointer like it did.
+func decodeLegacy(bs []byte) (*Container, error) {
+	var data interface{}
+	if err := gob.NewDecoder(bytes.NewReader(bs)).Decode(&data); err != nil {
+		// not a gob message either
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, ErrContainerVersion
+		}
+		return nil, err
+	}
+
+	v := reflect.ValueOf(data)
+	if v.Kind() == reflect.Struct {
+		legacyLock.RLock()
+		t, ok := legacyTypes[v.Type()]
+		legacyLock.RUnlock()
+
+		if ok {
+			ptr := reflect.New(t)
+			// field 0 is the tag of the shadow
+			for i := 1; i < v.NumField(); i++ {
+				ptr.Elem().FieldByName(v.Type().Field(i).Name).Set(v.Field(i))
+			}
+			data = ptr.Interface()
+		} else {
+			ptr := reflect.New(v.Type())
+			ptr.Elem().Set(v)
+			data = ptr.Interface()
+		}
+	}
+	now := time.Now()
+	return &Container{Data: data, CreateTime: now, LastTime: now, Changed: true}, nil
+}
+
+// registerLegacy registers the gob name of the baseline stores for struct t,
+// which is registered as pointer. gob can't register t by two names, so the
+// name is given to a shadow struct of the exported fields of t, which are
+// the fields gob encodes, tagged by the name to be unique.
+func registerLegacy(t reflect.Type) {
+	name := typeName(t)
+	fields := []reflect.StructField{{
+		Name: "Legacy_",
+		Type: reflect.TypeOf(struct{}{}),
+		Tag:  reflect.StructTag(`session:"` + name + `"`),
+	}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		f.Anonymous = false
+		f.Index = nil
+		f.Offset = 0
+		fields = append(fields, f)
+	}
+	shadow := reflect.StructOf(fields)
+
+	legacyLock.Lock()
+	defer legacyLock.Unlock()
+	if _, ok := legacyTypes[shadow]; ok {
+		return
+	}
+	legacyTypes[shadow] = t
+	gob.RegisterName(name, reflect.New(shadow).Elem().Interface())
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// GobSerializer uses encoding/gob, data types should be registered by RegisterType.
+// An unregistered type is registered on its first Encode like the baseline
+// stores did, so it can't be decoded by a process which hasn't stored it yet.
+type GobSerializer struct{}
+
+func (GobSerializer) Encode(data interface{}) ([]byte, error) {
+	if data != nil {
+		if _, err := lookupType(data); err != nil {
+			if err = autoRegister(data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&data); err != nil {
+		return nil, err
+	}
+	return withVersion(b.Bytes()), nil
+}
+
+func (GobSerializer) Decode(bs []byte) (interface{}, error) {
+	body, err := stripVersion(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	var data interface{}
+	if err = gob.NewDecoder(bytes.NewReader(body)).Decode(&data); err != nil {
+		if strings.Contains(err.Error(), "not registered") {
+			return nil, fmt.Errorf("%w: %v, call RegisterType at init", ErrUnregisteredType, err)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// autoRegister registers the type of data for gob, gob panics when the type
+// is already registered as pointer or as value.
+func autoRegister(data interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %s, call RegisterType at init: %v", ErrUnregisteredType, typeName(reflect.TypeOf(data)), r)
+		}
+	}()
+
+	RegisterType(data)
+	return nil
+}
+
+type jsonEnvelope struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+// JSONSerializer uses encoding/json, data types must be registered by RegisterType.
+type JSONSerializer struct{}
+
+func (JSONSerializer) Encode(data interface{}) ([]byte, error) {
+	name, err := lookupType(data)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := json.Marshal(&jsonEnvelope{Type: name, Value: v})
+	if err != nil {
+		return nil, err
+	}
+	return withVersion(bs), nil
+}
+
+func (JSONSerializer) Decode(bs []byte) (interface{}, error) {
+	body, err := stripVersion(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	var e jsonEnvelope
+	if err = json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+
+	ptr, err := newOfType(e.Type)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(e.Value, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+type msgpackEnvelope struct {
+	Type  string             `msgpack:"t"`
+	Value msgpack.RawMessage `msgpack:"v"`
+}
+
+// MsgpackSerializer uses msgpack, data types must be registered by RegisterType.
+type MsgpackSerializer struct{}
+
+func (MsgpackSerializer) Encode(data interface{}) ([]byte, error) {
+	name, err := lookupType(data)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := msgpack.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := msgpack.Marshal(&msgpackEnvelope{Type: name, Value: v})
+	if err != nil {
+		return nil, err
+	}
+	return withVersion(bs), nil
+}
+
+func (MsgpackSerializer) Decode(bs []byte) (interface{}, error) {
+	body, err := stripVersion(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	var e msgpackEnvelope
+	if err = msgpack.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+
+	ptr, err := newOfType(e.Type)
+	if err != nil {
+		return nil, err
+	}
+	if err = msgpack.Unmarshal(e.Value, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+func init() {
+	RegisterSerializer("gob", GobSerializer{})
+	RegisterSerializer("json", JSONSerializer{})
+	RegisterSerializer("msgpack", MsgpackSerializer{})
+
+	// common builtin types
+	RegisterType("")
+	RegisterType(map[string]interface{}{})
+	RegisterType(map[string]string{})
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testUser struct {
+	Name string
+	Age  int
+}
+
+type testToken struct {
+	Value string
+}
+
+// testAdmin has the fields of testUser, their legacy names mustn't collide.
+type testAdmin struct {
+	Name string
+	Age  int
+}
+
+type unregistered struct {
+	Name string
+}
+
+type autoRegistered struct {
+	Name string
+}
+
+func init() {
+	RegisterType(&testUser{})
+	RegisterType(testToken{})
+	RegisterType(&testAdmin{})
+}
+
+func Test_Serializer(t *testing.T) {
+	for _, name := range []string{"gob", "json", "msgpack"} {
+		s, err := GetSerializer(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		Convey("Round trip with "+name, t, func() {
+			bs, err := s.Encode(&testUser{Name: "chen", Age: 18})
+			So(err, ShouldBeNil)
+			So(bs[0], ShouldEqual, SerializerVersion)
+
+			v, err := s.Decode(bs)
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, &testUser{Name: "chen", Age: 18})
+
+			bs, err = s.Encode(testToken{Value: "abc"})
+			So(err, ShouldBeNil)
+			v, err = s.Decode(bs)
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, testToken{Value: "abc"})
+
+			bs, err = s.Encode(map[string]interface{}{"name": "chen"})
+			So(err, ShouldBeNil)
+			v, err = s.Decode(bs)
+			So(err, ShouldBeNil)
+			So(v.(map[string]interface{})["name"], ShouldEqual, "chen")
+		})
+
+		Convey("Bad payload with "+name, t, func() {
+			_, err := s.Decode(nil)
+			So(err, ShouldEqual, ErrEmptyPayload)
+
+			_, err = s.Decode([]byte{SerializerVersion + 1, 0})
+			So(err, ShouldEqual, ErrSerializerVersion)
+		})
+	}
+
+	Convey("Legacy payload of the baseline stores", t, func() {
+		// gob of &Data with the struct registered by value
+		user := []byte("[\x10\x002github.com/meilihao/water-contrib/session.testUser\x7f\x03\x01\x01\btestUser\x01\xff\x80\x00\x01\x02\x01\x04Name\x01\f\x00\x01\x03Age\x01\x04\x00\x00\x00\f\xff\x80\t\x01\x04chen\x01$\x00")
+		c, err := DecodeContainer(GobSerializer{}, user)
+		So(err, ShouldBeNil)
+		So(c.Data, ShouldResemble, &testUser{Name: "chen", Age: 18})
+		So(c.Changed, ShouldBeTrue)
+		So(c.CreateTime.IsZero(), ShouldBeFalse)
+		version, err := PeekVersion(user)
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, 0)
+
+		c, err = DecodeContainer(GobSerializer{}, []byte("\x0e\x10\x00\x06string\f\x03\x00\x01a"))
+		So(err, ShouldBeNil)
+		So(c.Data, ShouldEqual, "a")
+
+		c, err = DecodeContainer(JSONSerializer{}, []byte("(\x10\x00\x17map[string]interface {}\xff\x81\x04\x01\x02\xff\x82\x00\x01\f\x01\x10\x00\x00\x19\xff\x82\x16\x00\x01\x04name\x06string\f\x06\x00\x04chen"))
+		So(err, ShouldBeNil)
+		So(c.Data.(map[string]interface{})["name"], ShouldEqual, "chen")
+
+		// it's stored in the current format
+		bs, err := EncodeContainer(GobSerializer{}, c)
+		So(err, ShouldBeNil)
+		So(bs[0], ShouldEqual, ContainerVersion)
+	})
+
+	Convey("Unregistered type", t, func() {
+		_, err := JSONSerializer{}.Encode(&unregistered{})
+		So(errors.Is(err, ErrUnregisteredType), ShouldBeTrue)
+	})
+
+	Convey("Gob registers the type on first use", t, func() {
+		bs, err := GobSerializer{}.Encode(&autoRegistered{Name: "chen"})
+		So(err, ShouldBeNil)
+		v, err := GobSerializer{}.Decode(bs)
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, &autoRegistered{Name: "chen"})
+
+		// registered as pointer, stored as value
+		_, err = GobSerializer{}.Encode(autoRegistered{Name: "chen"})
+		So(errors.Is(err, ErrUnregisteredType), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, "RegisterType")
+	})
+
+	Convey("Unknown serializer", t, func() {
+		_, err := GetSerializer("xml")
+		So(err, ShouldNotBeNil)
+
+		s, err := GetSerializer("")
+		So(err, ShouldBeNil)
+		So(s, ShouldHaveSameTypeAs, GobSerializer{})
+	})
+}
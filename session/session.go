@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/internal/pathutil"
 )
 
 func init() {
@@ -18,11 +19,98 @@ func init() {
 }
 
 type Options struct {
-	Store            Store
-	Generator        IdGenerator
-	Tracker          Tracker
+	Store     Store
+	Generator IdGenerator
+	Tracker   Tracker
+	// IdleTimeout invalidates session which isn't accessed for the duration, 0 disables it
+	IdleTimeout time.Duration
+	// AbsoluteTimeout invalidates session created before the duration, 0 disables it
+	AbsoluteTimeout  time.Duration
 	OnSessionNew     func(*Session)
 	OnSessionRelease func(*Session)
+	// OnSessionExpired is called with the old session before a fresh one is created
+	OnSessionExpired func(*Session, ExpireReason)
+	// TouchInterval is the minimal interval to store LastTime of an unchanged session
+	// when IdleTimeout is set, default is 1 minute and at most IdleTimeout/2
+	TouchInterval time.Duration
+	// SkipPaths are path.Match patterns bypassing the middleware, a pattern ending
+	// with "**" matches the prefix, e.g. "/static/**"
+	SkipPaths []string
+	// Concurrency handles parallel requests of the same session, Store must
+	// implement CASStore or Locker for it
+	Concurrency Concurrency
+	// OnConflict merges the session with the stored one when CAS fails, it returns
+	// the container to retry with, or false to drop the changes
+	OnConflict func(sess *Session, stored *Container) (*Container, bool)
+	// ConflictRetries limits the retries of CAS, default is 3
+	ConflictRetries int
+	// LockTimeout is the max wait for the session lock, default is 5 seconds
+	LockTimeout time.Duration
+	// OnEvent receives every session event, e.g. NewAuditLogger
+	OnEvent func(*Event)
+	// ErrorHandler handles the failure of store or tracker operation op, it's
+	// logged by default
+	ErrorHandler func(ctx *water.Context, op string, err error)
+	// FingerprintPolicy binds session to the ip subnet and user agent of the
+	// client creating it, a mismatch is handled by the policy
+	FingerprintPolicy FingerprintPolicy
+	// IPv4Mask and IPv6Mask are the prefix lengths of the ip subnet, default
+	// are 24 and 64
+	IPv4Mask int
+	IPv6Mask int
+	// OnSuspicious decides the policy for a mismatch instead of FingerprintPolicy
+	OnSuspicious func(sess *Session, m Mismatch) FingerprintPolicy
+}
+
+// Concurrency is the way to handle parallel requests of the same session.
+type Concurrency int
+
+const (
+	// ConcurrencyNone lets the last writer win
+	ConcurrencyNone Concurrency = iota
+	// ConcurrencyCAS stores session by compare-and-set on Container.Version
+	ConcurrencyCAS
+	// ConcurrencyLock holds a per-session lock from loading to storing
+	ConcurrencyLock
+)
+
+func (opt *Options) skip(p string) bool {
+	for _, pattern := range opt.SkipPaths {
+		if pathutil.Match(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpireReason tells why session is invalidated by middleware.
+type ExpireReason int
+
+const (
+	ExpireNone ExpireReason = iota
+	ExpireIdle
+	ExpireAbsolute
+)
+
+func (r ExpireReason) String() string {
+	switch r {
+	case ExpireIdle:
+		return "idle timeout"
+	case ExpireAbsolute:
+		return "absolute timeout"
+	default:
+		return "none"
+	}
+}
+
+func (opt *Options) expired(c *Container, now time.Time) ExpireReason {
+	if opt.AbsoluteTimeout > 0 && !c.CreateTime.IsZero() && now.Sub(c.CreateTime) >= opt.AbsoluteTimeout {
+		return ExpireAbsolute
+	}
+	if opt.IdleTimeout > 0 && !c.LastTime.IsZero() && now.Sub(c.LastTime) >= opt.IdleTimeout {
+		return ExpireIdle
+	}
+	return ExpireNone
 }
 
 type Container struct {
@@ -30,6 +118,14 @@ type Container struct {
 	CreateTime time.Time
 	LastTime   time.Time
 	Changed    bool
+	// Version is increased by CASStore on every store
+	Version int64
+	// ClientNet and UserAgent are the fingerprint of the client creating the
+	// session, see Options.FingerprintPolicy
+	ClientNet string
+	UserAgent string
+	// UserId is the user bound by BindUser, its index follows Regenerate
+	UserId string
 }
 
 type Session struct {
@@ -38,58 +134,314 @@ type Session struct {
 
 	manager *Options
 	ctx     *water.Context
+	loaded  bool
+	// isNew is set when the session is started in the request
+	isNew bool
+	// destroyed session isn't stored on release
+	destroyed bool
+	// readOnly session isn't stored on release, the lock of ConcurrencyLock
+	// isn't held
+	readOnly bool
+	unlock   func() error
 }
 
 func New(opt *Options) water.HandlerFunc {
+	if opt.TouchInterval <= 0 {
+		opt.TouchInterval = time.Minute
+	}
+	if opt.ConflictRetries <= 0 {
+		opt.ConflictRetries = 3
+	}
+	if opt.LockTimeout <= 0 {
+		opt.LockTimeout = 5 * time.Second
+	}
+	if opt.IPv4Mask <= 0 || opt.IPv4Mask > 32 {
+		opt.IPv4Mask = 24
+	}
+	if opt.IPv6Mask <= 0 || opt.IPv6Mask > 128 {
+		opt.IPv6Mask = 64
+	}
+	switch opt.Concurrency {
+	case ConcurrencyCAS:
+		if _, ok := opt.Store.(CASStore); !ok {
+			panic("session : store doesn't support ConcurrencyCAS")
+		}
+	case ConcurrencyLock:
+		if _, ok := opt.Store.(Locker); !ok {
+			panic("session : store doesn't support ConcurrencyLock")
+		}
+	}
+
 	return func(ctx *water.Context) {
+		if opt.skip(ctx.Req.URL.Path) {
+			ctx.Next()
+			return
+		}
+
 		sess := &Session{manager: opt, ctx: ctx}
 		ctx.Environ.Set("Session", sess)
-
-		sess.init()
+		defer sess.releaseLock()
 
 		ctx.Next()
 
-		var err error
-		sess.Container.LastTime = time.Now()
-		if err = sess.manager.Store.Set(sess.Id, sess.Container); err != nil {
-			log.Println("session : error(1):" + err.Error())
+		// handler never touches session
+		if !sess.loaded || sess.destroyed || sess.readOnly {
 			return
 		}
-		if sess.manager.OnSessionRelease != nil {
-			sess.manager.OnSessionRelease(sess)
+
+		sess.release()
+	}
+}
+
+func (sess *Session) release() {
+	var err error
+	now := time.Now()
+	// LastTime must be stored for idle timeout, but not on every request
+	if sess.manager.IdleTimeout > 0 {
+		interval := sess.manager.TouchInterval
+		if interval > sess.manager.IdleTimeout/2 {
+			interval = sess.manager.IdleTimeout / 2
+		}
+		if now.Sub(sess.Container.LastTime) >= interval {
+			sess.Container.Changed = true
+		}
+	}
+
+	if sess.Container.Changed {
+		sess.Container.LastTime = now
+		if sess.manager.Concurrency == ConcurrencyCAS {
+			err = sess.setCAS()
+		} else {
+			err = sess.manager.Store.Set(sess.Id, sess.Container)
+		}
+	} else if t, ok := sess.manager.Store.(Toucher); ok {
+		err = t.Touch(sess.Id)
+	}
+	if err != nil {
+		sess.fail("store", err)
+		return
+	}
+
+	if sess.manager.OnSessionRelease != nil {
+		sess.manager.OnSessionRelease(sess)
+	}
+}
+
+// setCAS stores session by compare-and-set, and merges it by OnConflict on conflict
+func (sess *Session) setCAS() error {
+	store := sess.manager.Store.(CASStore)
+
+	for i := 0; ; i++ {
+		err := store.SetCAS(sess.Id, sess.Container)
+		if err != ErrConflict || sess.manager.OnConflict == nil || i >= sess.manager.ConflictRetries {
+			return err
+		}
+
+		stored := sess.manager.Store.Get(sess.Id)
+		if stored == nil {
+			// deleted by others
+			return err
+		}
+
+		merged, ok := sess.manager.OnConflict(sess, stored)
+		if !ok || merged == nil {
+			return err
 		}
+		merged.Version = stored.Version
+		merged.LastTime = sess.Container.LastTime
+		merged.Changed = true
+		sess.Container = merged
 	}
 }
 
+func (sess *Session) releaseLock() {
+	if sess.unlock == nil {
+		return
+	}
+
+	if err := sess.unlock(); err != nil {
+		sess.fail("unlock", err)
+	}
+	sess.unlock = nil
+}
+
+// load loads session on first access
+func (sess *Session) load() {
+	if sess.loaded {
+		return
+	}
+	sess.loaded = true
+
+	sess.init()
+}
+
 func (sess *Session) init() {
 	var err error
 	if sess.Id, err = sess.manager.Tracker.Get(sess.ctx); err != nil {
-		log.Println("session : error(2):" + err.Error())
+		sess.fail("track", err)
 	}
 
 	if sess.Id == "" || !sess.manager.Generator.IsValid(sess.Id) {
 		sess.Id = sess.manager.Generator.Gen(sess.ctx.Req)
 		sess.manager.Tracker.Set(sess.ctx, sess.Id)
 
-		sess.Container = newContainer()
+		sess.start()
+		return
+	}
+
+	if sess.manager.Concurrency == ConcurrencyLock {
+		if sess.unlock, err = sess.manager.Store.(Locker).Lock(sess.Id, sess.manager.LockTimeout); err != nil {
+			// storing without the lock would overwrite the holder's changes
+			sess.readOnly = true
+			sess.fail("lock", err)
+		}
+	}
+
+	sess.Container = sess.manager.Store.Get(sess.Id)
+	// session is timeout in store or never stored
+	if sess.Container == nil {
+		sess.start()
+		return
+	}
 
-		if sess.manager.OnSessionNew != nil {
-			sess.manager.OnSessionNew(sess)
+	if reason := sess.manager.expired(sess.Container, time.Now()); reason != ExpireNone {
+		if sess.manager.OnSessionExpired != nil {
+			sess.manager.OnSessionExpired(sess, reason)
 		}
-	} else {
-		sess.Container = sess.Get(sess.Id)
+		sess.manager.emit(sess.ctx, &Event{
+			Type:   EventExpired,
+			Id:     sess.Id,
+			Reason: reason,
+		})
+		if err = sess.manager.Store.Del(sess.Id); err != nil {
+			sess.fail("del", err)
+		}
+
+		sess.Id = sess.manager.Generator.Gen(sess.ctx.Req)
+		sess.manager.Tracker.Set(sess.ctx, sess.Id)
+
+		sess.start()
+		return
+	}
+
+	sess.manager.emit(sess.ctx, &Event{
+		Type: EventLoaded,
+		Id:   sess.Id,
+	})
+
+	if sess.manager.FingerprintPolicy != FingerprintIgnore || sess.manager.OnSuspicious != nil {
+		sess.checkFingerprint()
 	}
 }
 
+// start begins a fresh container
+func (sess *Session) start() {
+	sess.Container = newContainer()
+	sess.isNew = true
+	if sess.manager.FingerprintPolicy != FingerprintIgnore || sess.manager.OnSuspicious != nil {
+		sess.bind()
+	}
+
+	if sess.manager.OnSessionNew != nil {
+		sess.manager.OnSessionNew(sess)
+	}
+	sess.manager.emit(sess.ctx, &Event{
+		Type: EventCreated,
+		Id:   sess.Id,
+	})
+}
+
+// ReadOnly reports whether the changes of session are dropped, because the
+// lock of ConcurrencyLock can't be acquired.
+func (sess *Session) ReadOnly() bool {
+	sess.load()
+	return sess.readOnly
+}
+
+// IsNew reports whether the session is started in the request, i.e. the
+// client has no live session.
+func (sess *Session) IsNew() bool {
+	sess.load()
+	return sess.isNew
+}
+
+// Regenerate moves the session to a new id, e.g. after login to prevent
+// session fixation. The data is stored under the new id after the request.
+func (sess *Session) Regenerate() error {
+	sess.load()
+	if sess.destroyed {
+		return ErrDestroyed
+	}
+
+	oldId := sess.Id
+	if err := sess.manager.Store.Del(oldId); err != nil {
+		return err
+	}
+
+	sess.Id = sess.manager.Generator.Gen(sess.ctx.Req)
+	sess.manager.Tracker.Set(sess.ctx, sess.Id)
+	sess.Container.Changed = true
+	// it's a new record for CASStore
+	sess.Container.Version = 0
+
+	// the user's index follows the new id
+	if indexer, ok := sess.manager.Store.(Indexer); ok && sess.UserId != "" {
+		if err := indexer.Unbind(sess.UserId, oldId); err != nil {
+			return err
+		}
+		if err := sess.BindUser(sess.UserId); err != nil {
+			return err
+		}
+	}
+
+	sess.manager.emit(sess.ctx, &Event{
+		Type:  EventRegenerated,
+		Id:    sess.Id,
+		OldId: oldId,
+	})
+	return nil
+}
+
+// Destroy deletes the session and clears its id from client, e.g. logout.
+// The session isn't stored after the request.
+func (sess *Session) Destroy() error {
+	sess.load()
+	if sess.destroyed {
+		return nil
+	}
+
+	if err := sess.manager.Store.Del(sess.Id); err != nil {
+		return err
+	}
+	sess.manager.Tracker.Clear(sess.ctx)
+	sess.destroyed = true
+
+	sess.manager.emit(sess.ctx, &Event{
+		Type: EventDestroyed,
+		Id:   sess.Id,
+	})
+	return nil
+}
+
 func newContainer() *Container {
+	now := time.Now()
 	return &Container{
 		Changed:    true,
-		CreateTime: time.Now(),
+		CreateTime: now,
+		LastTime:   now,
 	}
 }
 
+// Get returns the session which is loaded on first call, it's nil when the
+// request is skipped by Options.SkipPaths.
 func Get(ctx *water.Context) *Session {
-	return ctx.Environ.Get("Session").(*Session)
+	sess, _ := ctx.Environ.Get("Session").(*Session)
+	if sess == nil {
+		return nil
+	}
+
+	sess.load()
+	return sess
 }
 
 func (sess *Session) Get(id string) *Container {
@@ -0,0 +1,442 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meilihao/water"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testStore keeps encoded containers like the real stores
+type testStore struct {
+	lock  sync.Mutex
+	m     map[string][]byte
+	locks map[string]chan struct{}
+
+	gets, sets, touches int
+	// err fails Set
+	err error
+}
+
+func newTestStore() *testStore {
+	return &testStore{m: make(map[string][]byte), locks: make(map[string]chan struct{})}
+}
+
+func (s *testStore) Get(id string) *Container {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.gets++
+	bs, ok := s.m[id]
+	if !ok {
+		return nil
+	}
+	c, err := DecodeContainer(GobSerializer{}, bs)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+func (s *testStore) Set(id string, c *Container) error {
+	if s.err != nil {
+		return s.err
+	}
+	if !c.Changed {
+		return nil
+	}
+	bs, err := EncodeContainer(GobSerializer{}, c)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.sets++
+	s.m[id] = bs
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *testStore) SetCAS(id string, c *Container) error {
+	if !c.Changed {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var version int64
+	if bs, ok := s.m[id]; ok {
+		version, _ = PeekVersion(bs)
+	}
+	if version != c.Version {
+		return ErrConflict
+	}
+
+	next := *c
+	next.Version++
+	bs, err := EncodeContainer(GobSerializer{}, &next)
+	if err != nil {
+		return err
+	}
+	s.sets++
+	s.m[id] = bs
+	c.Version = next.Version
+	return nil
+}
+
+func (s *testStore) Lock(id string, timeout time.Duration) (func() error, error) {
+	s.lock.Lock()
+	ch, ok := s.locks[id]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		s.locks[id] = ch
+	}
+	s.lock.Unlock()
+
+	select {
+	case ch <- struct{}{}:
+		return func() error {
+			<-ch
+			return nil
+		}, nil
+	case <-time.After(timeout):
+		return nil, ErrLockTimeout
+	}
+}
+
+func (s *testStore) Touch(id string) error {
+	s.lock.Lock()
+	s.touches++
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *testStore) Del(id string) error {
+	s.lock.Lock()
+	delete(s.m, id)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *testStore) Flush() error {
+	s.lock.Lock()
+	s.m = make(map[string][]byte)
+	s.lock.Unlock()
+	return nil
+}
+
+func newTestOptions() *Options {
+	return &Options{
+		Store:     newTestStore(),
+		Generator: NewSha256Generator("0123456789abcdef"),
+		Tracker:   NewCookieTracker("session", 0, false, "/", ""),
+	}
+}
+
+func serve(router *water.Router, path, cookie string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	if cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func Test_Container(t *testing.T) {
+	Convey("Container keeps metadata", t, func() {
+		now := time.Now()
+		c := &Container{Data: &testUser{Name: "chen"}, CreateTime: now.Add(-time.Hour), LastTime: now, UserId: "1"}
+
+		bs, err := EncodeContainer(JSONSerializer{}, c)
+		So(err, ShouldBeNil)
+		So(bs[0], ShouldEqual, ContainerVersion)
+
+		c2, err := DecodeContainer(JSONSerializer{}, bs)
+		So(err, ShouldBeNil)
+		So(c2.Data, ShouldResemble, c.Data)
+		So(c2.CreateTime.Equal(c.CreateTime), ShouldBeTrue)
+		So(c2.LastTime.Equal(c.LastTime), ShouldBeTrue)
+		So(c2.UserId, ShouldEqual, "1")
+
+		bs, err = EncodeContainer(JSONSerializer{}, &Container{})
+		So(err, ShouldBeNil)
+		c2, err = DecodeContainer(JSONSerializer{}, bs)
+		So(err, ShouldBeNil)
+		So(c2.Data, ShouldBeNil)
+		So(c2.CreateTime.IsZero(), ShouldBeTrue)
+
+		_, err = DecodeContainer(JSONSerializer{}, []byte{ContainerVersion + 1})
+		So(err, ShouldEqual, ErrContainerVersion)
+	})
+}
+
+func Test_Timeout(t *testing.T) {
+	Convey("Session expires", t, func() {
+		opt := newTestOptions()
+
+		var reason ExpireReason
+		var created, last time.Time
+		opt.OnSessionExpired = func(sess *Session, r ExpireReason) {
+			reason = r
+		}
+
+		router := water.NewRouter()
+		router.Before(New(opt))
+		router.Get("/", func(ctx *water.Context) {
+			sess := Get(ctx)
+			if sess.Data == nil {
+				sess.Data = &testUser{Name: "chen"}
+				sess.Changed = true
+			}
+			created, last = sess.CreateTime, sess.LastTime
+		})
+
+		resp := serve(router, "/", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		first := created
+
+		Convey("CreateTime is kept", func() {
+			time.Sleep(10 * time.Millisecond)
+			resp = serve(router, "/", cookie)
+			So(resp.Header().Get("Set-Cookie"), ShouldBeEmpty)
+			So(created.Equal(first), ShouldBeTrue)
+			So(last.After(first), ShouldBeTrue)
+		})
+
+		Convey("By idle timeout", func() {
+			opt.IdleTimeout = 50 * time.Millisecond
+			serve(router, "/", cookie)
+			time.Sleep(60 * time.Millisecond)
+
+			resp = serve(router, "/", cookie)
+			So(reason, ShouldEqual, ExpireIdle)
+			So(resp.Header().Get("Set-Cookie"), ShouldNotBeEmpty)
+			So(resp.Header().Get("Set-Cookie"), ShouldNotEqual, cookie)
+			So(created.After(first), ShouldBeTrue)
+		})
+
+		Convey("By absolute timeout", func() {
+			opt.AbsoluteTimeout = 50 * time.Millisecond
+			time.Sleep(60 * time.Millisecond)
+
+			resp = serve(router, "/", cookie)
+			So(reason, ShouldEqual, ExpireAbsolute)
+			So(resp.Header().Get("Set-Cookie"), ShouldNotEqual, cookie)
+		})
+	})
+}
+
+func Test_Lazy(t *testing.T) {
+	Convey("Session is loaded and stored only when needed", t, func() {
+		opt := newTestOptions()
+		opt.SkipPaths = []string{"/static/**", "/*.ico"}
+		store := opt.Store.(*testStore)
+
+		router := water.NewRouter()
+		router.Before(New(opt))
+		router.Get("/", func(ctx *water.Context) {
+			sess := Get(ctx)
+			if sess.Data == nil {
+				sess.Data = &testUser{Name: "chen"}
+				sess.Changed = true
+			}
+		})
+		router.Get("/read", func(ctx *water.Context) {
+			So(Get(ctx).Data, ShouldNotBeNil)
+		})
+		router.Get("/none", func(ctx *water.Context) {})
+		router.Get("/static/app.js", func(ctx *water.Context) {
+			So(Get(ctx), ShouldBeNil)
+		})
+		router.Get("/favicon.ico", func(ctx *water.Context) {
+			So(Get(ctx), ShouldBeNil)
+		})
+
+		resp := serve(router, "/", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		So(cookie, ShouldNotBeEmpty)
+		So(store.sets, ShouldEqual, 1)
+
+		Convey("Untouched session isn't loaded", func() {
+			resp = serve(router, "/none", "")
+			So(resp.Header().Get("Set-Cookie"), ShouldBeEmpty)
+
+			serve(router, "/none", cookie)
+			So(store.gets, ShouldEqual, 0)
+			So(store.sets, ShouldEqual, 1)
+		})
+
+		Convey("Unchanged session is touched", func() {
+			serve(router, "/read", cookie)
+			So(store.gets, ShouldEqual, 1)
+			So(store.sets, ShouldEqual, 1)
+			So(store.touches, ShouldEqual, 1)
+		})
+
+		Convey("Skipped paths", func() {
+			serve(router, "/static/app.js", cookie)
+			serve(router, "/favicon.ico", cookie)
+			So(store.gets, ShouldEqual, 0)
+			So(store.touches, ShouldEqual, 0)
+		})
+
+		Convey("LastTime is stored for idle timeout", func() {
+			opt.IdleTimeout = 100 * time.Millisecond
+			serve(router, "/read", cookie)
+			So(store.sets, ShouldEqual, 1)
+
+			time.Sleep(60 * time.Millisecond)
+			serve(router, "/read", cookie)
+			So(store.sets, ShouldEqual, 2)
+		})
+	})
+}
+
+type testCounter struct {
+	A, B int
+}
+
+func init() {
+	RegisterType(&testCounter{})
+}
+
+func Test_Concurrency(t *testing.T) {
+	Convey("Parallel requests of the same session", t, func() {
+		opt := newTestOptions()
+
+		// a and b are loaded before any is stored
+		loaded := make(chan struct{}, 2)
+		proceed := make(chan struct{})
+
+		router := water.NewRouter()
+		router.Before(New(opt))
+		router.Get("/", func(ctx *water.Context) {
+			sess := Get(ctx)
+			sess.Data = &testCounter{}
+			sess.Changed = true
+		})
+		inc := func(f func(*testCounter)) water.HandlerFunc {
+			return func(ctx *water.Context) {
+				sess := Get(ctx)
+				loaded <- struct{}{}
+				<-proceed
+
+				c := *sess.Data.(*testCounter)
+				f(&c)
+				sess.Data = &c
+				sess.Changed = true
+			}
+		}
+		router.Get("/a", inc(func(c *testCounter) { c.A++ }))
+		router.Get("/b", inc(func(c *testCounter) { c.B++ }))
+
+		resp := serve(router, "/", "")
+		cookie := resp.Header().Get("Set-Cookie")
+
+		parallel := func() {
+			var wg sync.WaitGroup
+			for _, p := range []string{"/a", "/b"} {
+				wg.Add(1)
+				go func(p string) {
+					defer wg.Done()
+					serve(router, p, cookie)
+				}(p)
+			}
+			if opt.Concurrency == ConcurrencyLock {
+				// the second one waits for the lock
+				<-loaded
+				close(proceed)
+				<-loaded
+			} else {
+				<-loaded
+				<-loaded
+				close(proceed)
+			}
+			wg.Wait()
+		}
+		result := func() testCounter {
+			var c testCounter
+			router.Get("/result", func(ctx *water.Context) {
+				c = *Get(ctx).Data.(*testCounter)
+			})
+			serve(router, "/result", cookie)
+			return c
+		}
+
+		Convey("Last writer wins without concurrency", func() {
+			parallel()
+			c := result()
+			So(c.A+c.B, ShouldEqual, 1)
+		})
+
+		Convey("CAS drops the conflicted update", func() {
+			opt.Concurrency = ConcurrencyCAS
+			parallel()
+			c := result()
+			So(c.A+c.B, ShouldEqual, 1)
+		})
+
+		Convey("CAS merges by OnConflict", func() {
+			opt.Concurrency = ConcurrencyCAS
+			opt.OnConflict = func(sess *Session, stored *Container) (*Container, bool) {
+				mine, theirs := sess.Data.(*testCounter), stored.Data.(*testCounter)
+				stored.Data = &testCounter{A: mine.A + theirs.A, B: mine.B + theirs.B}
+				return stored, true
+			}
+			parallel()
+			So(result(), ShouldResemble, testCounter{A: 1, B: 1})
+		})
+
+		Convey("Lock serializes the requests", func() {
+			opt.Concurrency = ConcurrencyLock
+			parallel()
+			So(result(), ShouldResemble, testCounter{A: 1, B: 1})
+		})
+
+		Convey("Session is read-only without the lock", func() {
+			opt.Concurrency = ConcurrencyLock
+			opt.LockTimeout = 50 * time.Millisecond
+			var errs []string
+			opt.ErrorHandler = func(ctx *water.Context, op string, err error) {
+				errs = append(errs, op)
+			}
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				serve(router, "/a", cookie)
+			}()
+			// a holds the lock
+			<-loaded
+			go func() {
+				defer wg.Done()
+				serve(router, "/b", cookie)
+			}()
+			// b times out and is loaded without the lock
+			<-loaded
+			close(proceed)
+			wg.Wait()
+
+			So(errs, ShouldResemble, []string{"lock"})
+			So(result(), ShouldResemble, testCounter{A: 1})
+		})
+	})
+
+	Convey("Store must support the concurrency", t, func() {
+		So(func() {
+			New(&Options{Store: struct{ Store }{newTestStore()}, Concurrency: ConcurrencyCAS})
+		}, ShouldPanic)
+	})
+}
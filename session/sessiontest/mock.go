@@ -0,0 +1,173 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessiontest
+
+import (
+	"sync"
+
+	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/session"
+)
+
+var (
+	_ session.Store   = &MockStore{}
+	_ session.Toucher = &MockStore{}
+	_ session.Tracker = &MockTracker{}
+)
+
+// Call is an operation recorded by MockStore.
+type Call struct {
+	// Op is one of get, set, touch, del and flush
+	Op string
+	Id string
+}
+
+// MockStore is an in-memory session.Store recording its calls, Errors makes
+// an operation fail.
+type MockStore struct {
+	lock  sync.Mutex
+	items map[string]session.Container
+	calls []Call
+
+	// Errors maps Call.Op to the error it returns
+	Errors map[string]error
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{
+		items:  make(map[string]session.Container),
+		Errors: make(map[string]error),
+	}
+}
+
+func (s *MockStore) record(op, id string) error {
+	s.calls = append(s.calls, Call{Op: op, Id: id})
+	return s.Errors[op]
+}
+
+// Calls returns the recorded calls.
+func (s *MockStore) Calls() []Call {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Call(nil), s.calls...)
+}
+
+// Count returns the number of recorded calls of op.
+func (s *MockStore) Count(op string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for _, c := range s.calls {
+		if c.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// Reset clears the recorded calls, sessions are kept.
+func (s *MockStore) Reset() {
+	s.lock.Lock()
+	s.calls = nil
+	s.lock.Unlock()
+}
+
+func (s *MockStore) Get(id string) *session.Container {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.record("get", id) != nil {
+		return nil
+	}
+	c, ok := s.items[id]
+	if !ok {
+		return nil
+	}
+	return &c
+}
+
+func (s *MockStore) Set(id string, c *session.Container) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.record("set", id); err != nil {
+		return err
+	}
+	if !c.Changed {
+		return nil
+	}
+
+	stored := *c
+	stored.Changed = false
+	s.items[id] = stored
+	return nil
+}
+
+func (s *MockStore) Touch(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.record("touch", id)
+}
+
+func (s *MockStore) Del(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.record("del", id); err != nil {
+		return err
+	}
+	delete(s.items, id)
+	return nil
+}
+
+func (s *MockStore) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.record("flush", ""); err != nil {
+		return err
+	}
+	s.items = make(map[string]session.Container)
+	return nil
+}
+
+// MockTracker acts as a client keeping one session id: Get returns Id, and
+// Set and Clear change it.
+type MockTracker struct {
+	lock sync.Mutex
+	// Id is sent by the client
+	Id string
+	// Sets are the ids set by the middleware
+	Sets []string
+	// Clears counts Clear
+	Clears int
+}
+
+func (t *MockTracker) Get(ctx *water.Context) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.Id, nil
+}
+
+func (t *MockTracker) Set(ctx *water.Context, id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.Id = id
+	t.Sets = append(t.Sets, id)
+}
+
+func (t *MockTracker) Clear(ctx *water.Context) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.Id = ""
+	t.Clears++
+}
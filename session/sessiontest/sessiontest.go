@@ -0,0 +1,365 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sessiontest provides a conformance suite for session.Store
+// implementations, and mocks to test apps without a backend.
+package sessiontest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meilihao/water-contrib/session"
+)
+
+// Config describes the store under test.
+type Config struct {
+	// MaxAge is the ttl the store is created with, 0 skips the expiry test
+	MaxAge time.Duration
+	// Concurrency is the number of goroutines of the concurrency test, default is 16
+	Concurrency int
+}
+
+// TestStore runs the conformance suite, newStore must return an empty store
+// every time it's called.
+func TestStore(t *testing.T, newStore func(t *testing.T) session.Store, cfg Config) {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 16
+	}
+
+	t.Run("GetSet", func(t *testing.T) { testGetSet(t, newStore(t)) })
+	t.Run("NilData", func(t *testing.T) { testNilData(t, newStore(t)) })
+	t.Run("DelFlush", func(t *testing.T) { testDelFlush(t, newStore(t)) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, newStore(t), cfg.Concurrency) })
+
+	t.Run("Expiry", func(t *testing.T) {
+		if cfg.MaxAge <= 0 {
+			t.Skip("MaxAge is 0")
+		}
+		testExpiry(t, newStore(t), cfg.MaxAge)
+	})
+	t.Run("Touch", func(t *testing.T) {
+		store := newStore(t)
+		if _, ok := store.(session.Toucher); !ok {
+			t.Skip("store doesn't implement session.Toucher")
+		}
+		testTouch(t, store)
+	})
+	t.Run("CAS", func(t *testing.T) {
+		store := newStore(t)
+		if _, ok := store.(session.CASStore); !ok {
+			t.Skip("store doesn't implement session.CASStore")
+		}
+		testCAS(t, store)
+	})
+	t.Run("Scan", func(t *testing.T) {
+		store := newStore(t)
+		if _, ok := store.(session.Scanner); !ok {
+			t.Skip("store doesn't implement session.Scanner")
+		}
+		testScan(t, store)
+	})
+	t.Run("Lock", func(t *testing.T) {
+		store := newStore(t)
+		if _, ok := store.(session.Locker); !ok {
+			t.Skip("store doesn't implement session.Locker")
+		}
+		testLock(t, store)
+	})
+}
+
+func newContainer(data interface{}) *session.Container {
+	now := time.Now()
+	return &session.Container{
+		Data:       data,
+		CreateTime: now.Add(-time.Minute),
+		LastTime:   now,
+		Changed:    true,
+	}
+}
+
+func sameTime(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d < time.Millisecond && d > -time.Millisecond
+}
+
+func testGetSet(t *testing.T, store session.Store) {
+	if c := store.Get("missing"); c != nil {
+		t.Fatalf("Get of a missing id = %+v, want nil", c)
+	}
+
+	c := newContainer(map[string]string{"name": "chen"})
+	if err := store.Set("a", c); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	got := store.Get("a")
+	if got == nil {
+		t.Fatal("Get after Set = nil")
+	}
+	if m, ok := got.Data.(map[string]string); !ok || m["name"] != "chen" {
+		t.Errorf("Data = %#v, want %#v", got.Data, c.Data)
+	}
+	if !sameTime(got.CreateTime, c.CreateTime) || !sameTime(got.LastTime, c.LastTime) {
+		t.Errorf("times = %v/%v, want %v/%v", got.CreateTime, got.LastTime, c.CreateTime, c.LastTime)
+	}
+	if got.Changed {
+		t.Error("loaded container is Changed")
+	}
+
+	// overwrite
+	if err := store.Set("a", newContainer("b")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if got = store.Get("a"); got == nil || got.Data != "b" {
+		t.Errorf("Get after overwrite = %+v, want Data b", got)
+	}
+
+	// unchanged container isn't stored
+	unchanged := newContainer("c")
+	unchanged.Changed = false
+	if err := store.Set("a", unchanged); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if got = store.Get("a"); got == nil || got.Data != "b" {
+		t.Errorf("unchanged container is stored, Get = %+v", got)
+	}
+}
+
+func testNilData(t *testing.T, store session.Store) {
+	want := newContainer(nil)
+	if err := store.Set("a", want); err != nil {
+		t.Fatalf("Set of nil Data: %v", err)
+	}
+	c := store.Get("a")
+	if c == nil {
+		t.Fatal("Get after Set of nil Data = nil, the session must be stored")
+	}
+	if c.Data != nil || !sameTime(c.CreateTime, want.CreateTime) || !sameTime(c.LastTime, want.LastTime) {
+		t.Errorf("Get after Set of nil Data = %+v, want %+v", c, want)
+	}
+}
+
+func testDelFlush(t *testing.T, store session.Store) {
+	if err := store.Del("missing"); err != nil {
+		t.Errorf("Del of a missing id: %v", err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Set(id, newContainer(id)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	if err := store.Del("a"); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	if c := store.Get("a"); c != nil {
+		t.Errorf("Get after Del = %+v", c)
+	}
+	if c := store.Get("b"); c == nil {
+		t.Error("Del removes other sessions")
+	}
+
+	indexer, ok := store.(session.Indexer)
+	if ok {
+		if err := indexer.Bind("flush", &session.SessionInfo{Id: "b", UserId: "flush"}); err != nil {
+			t.Fatalf("Bind: %v", err)
+		}
+	}
+
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	for _, id := range []string{"b", "c"} {
+		if c := store.Get(id); c != nil {
+			t.Errorf("Get(%s) after Flush = %+v", id, c)
+		}
+	}
+	if ok {
+		if infos, err := indexer.Sessions("flush"); err != nil || len(infos) != 0 {
+			t.Errorf("Sessions after Flush = %v, %v, want empty", infos, err)
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, store session.Store, n int) {
+	var wg sync.WaitGroup
+	errs := make(chan error, n*2)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			id := fmt.Sprintf("own%d", i)
+			data := fmt.Sprintf("data%d", i)
+			if err := store.Set(id, newContainer(data)); err != nil {
+				errs <- err
+				return
+			}
+			if c := store.Get(id); c == nil || c.Data != data {
+				errs <- fmt.Errorf("Get(%s) = %+v, want Data %s", id, c, data)
+			}
+
+			// all writes the same id
+			if err := store.Set("shared", newContainer(data)); err != nil {
+				errs <- err
+			}
+			store.Get("shared")
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if c := store.Get("shared"); c == nil {
+		t.Error("shared session is lost")
+	}
+}
+
+func testExpiry(t *testing.T, store session.Store, maxAge time.Duration) {
+	if err := store.Set("a", newContainer("a")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if c := store.Get("a"); c == nil {
+		t.Fatal("Get before expiry = nil")
+	}
+
+	// some stores count ttl in seconds
+	time.Sleep(maxAge + time.Second)
+	if c := store.Get("a"); c != nil {
+		t.Errorf("Get after expiry = %+v", c)
+	}
+}
+
+func testTouch(t *testing.T, store session.Store) {
+	toucher := store.(session.Toucher)
+
+	if err := store.Set("a", newContainer("a")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := toucher.Touch("a"); err != nil {
+		t.Errorf("Touch: %v", err)
+	}
+	if c := store.Get("a"); c == nil || c.Data != "a" {
+		t.Errorf("Get after Touch = %+v", c)
+	}
+}
+
+func testCAS(t *testing.T, store session.Store) {
+	cas := store.(session.CASStore)
+
+	c := newContainer("a")
+	if err := cas.SetCAS("a", c); err != nil {
+		t.Fatalf("SetCAS of a new session: %v", err)
+	}
+	if c.Version != 1 {
+		t.Errorf("Version = %d, want 1", c.Version)
+	}
+	if got := store.Get("a"); got == nil || got.Version != 1 {
+		t.Errorf("Get after SetCAS = %+v, want Version 1", got)
+	}
+
+	if err := cas.SetCAS("a", newContainer("stale")); err != session.ErrConflict {
+		t.Errorf("SetCAS of a stale container = %v, want ErrConflict", err)
+	}
+
+	if err := cas.SetCAS("a", c); err != nil {
+		t.Fatalf("SetCAS: %v", err)
+	}
+	if c.Version != 2 {
+		t.Errorf("Version = %d, want 2", c.Version)
+	}
+	if got := store.Get("a"); got == nil || got.Data != "a" {
+		t.Errorf("Get after SetCAS = %+v, want Data a", got)
+	}
+}
+
+func testLock(t *testing.T, store session.Store) {
+	locker := store.(session.Locker)
+
+	unlock, err := locker.Lock("a", time.Second)
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if _, err = locker.Lock("a", 50*time.Millisecond); err != session.ErrLockTimeout {
+		t.Errorf("Lock of a held lock = %v, want ErrLockTimeout", err)
+	}
+
+	// other sessions aren't blocked
+	unlockB, err := locker.Lock("b", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Lock of another session: %v", err)
+	}
+	if err = unlockB(); err != nil {
+		t.Errorf("unlock: %v", err)
+	}
+
+	if err = unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	unlock, err = locker.Lock("a", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Lock after unlock: %v", err)
+	}
+	if err = unlock(); err != nil {
+		t.Errorf("unlock: %v", err)
+	}
+}
+
+func testScan(t *testing.T, store session.Store) {
+	scanner := store.(session.Scanner)
+
+	want := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("scan%d", i)
+		if err := store.Set(id, newContainer(id)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		want[id] = true
+	}
+	// locks mustn't be listed
+	if locker, ok := store.(session.Locker); ok {
+		unlock, err := locker.Lock("scan0", time.Second)
+		if err != nil {
+			t.Fatalf("Lock: %v", err)
+		}
+		defer unlock()
+	}
+
+	got := map[string]bool{}
+	cursor := ""
+	for i := 0; ; i++ {
+		if i > 10 {
+			t.Fatal("Scan doesn't end")
+		}
+
+		ids, next, err := scanner.Scan(cursor, 2)
+		if err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		for _, id := range ids {
+			got[id] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("Scan = %v, want %v", got, want)
+	}
+	for id := range want {
+		if !got[id] {
+			t.Errorf("Scan misses %s", id)
+		}
+	}
+}
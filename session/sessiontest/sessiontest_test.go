@@ -0,0 +1,77 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessiontest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/session"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MockStore(t *testing.T) {
+	TestStore(t, func(t *testing.T) session.Store {
+		return NewMockStore()
+	}, Config{})
+}
+
+func Test_MemoryStore(t *testing.T) {
+	TestStore(t, func(t *testing.T) session.Store {
+		return session.NewMemoryStore(1)
+	}, Config{MaxAge: time.Second})
+}
+
+func Test_Mock(t *testing.T) {
+	Convey("Session with mocks", t, func() {
+		store := NewMockStore()
+		tracker := &MockTracker{}
+
+		router := water.NewRouter()
+		router.Before(session.New(&session.Options{
+			Store:     store,
+			Generator: session.NewSha256Generator("0123456789abcdef"),
+			Tracker:   tracker,
+		}))
+		router.Get("/", func(ctx *water.Context) {
+			session.Get(ctx).Data = "a"
+		})
+		router.Get("/logout", func(ctx *water.Context) {
+			So(session.Get(ctx).Destroy(), ShouldBeNil)
+		})
+		serve := func(path string) {
+			req, _ := http.NewRequest("GET", path, nil)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		serve("/")
+		So(tracker.Sets, ShouldHaveLength, 1)
+		id := tracker.Id
+		So(store.Calls(), ShouldResemble, []Call{{Op: "set", Id: id}})
+
+		store.Reset()
+		serve("/")
+		So(tracker.Id, ShouldEqual, id)
+		So(store.Count("get"), ShouldEqual, 1)
+
+		store.Reset()
+		serve("/logout")
+		So(store.Count("del"), ShouldEqual, 1)
+		So(store.Count("set"), ShouldEqual, 0)
+		So(tracker.Clears, ShouldEqual, 1)
+		So(tracker.Id, ShouldBeEmpty)
+
+		Convey("Failed store", func() {
+			store.Errors["set"] = errors.New("down")
+			So(store.Set("a", &session.Container{Data: "a", Changed: true}), ShouldNotBeNil)
+			So(store.Get("a"), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,381 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/meilihao/water-contrib/session"
+)
+
+var (
+	_ session.Store    = &SqlStore{}
+	_ session.Toucher  = &SqlStore{}
+	_ session.CASStore = &SqlStore{}
+	_ session.Scanner  = &SqlStore{}
+)
+
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// dialect holds the sql differences between databases.
+type dialect struct {
+	schema string
+	upsert string
+	// placeholder style, postgres uses $n
+	numbered bool
+}
+
+var dialects = map[string]*dialect{
+	"sqlite3": {
+		schema: `CREATE TABLE IF NOT EXISTS %[1]s (
+	id VARCHAR(128) NOT NULL PRIMARY KEY,
+	data BLOB NOT NULL,
+	expiry BIGINT NOT NULL,
+	version BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS %[1]s_expiry_idx ON %[1]s (expiry);`,
+		upsert: `INSERT OR REPLACE INTO %s (id, data, expiry, version) VALUES (?, ?, ?, ?)`,
+	},
+	"postgres": {
+		schema: `CREATE TABLE IF NOT EXISTS %[1]s (
+	id VARCHAR(128) NOT NULL PRIMARY KEY,
+	data BYTEA NOT NULL,
+	expiry BIGINT NOT NULL,
+	version BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS %[1]s_expiry_idx ON %[1]s (expiry);`,
+		upsert: `INSERT INTO %s (id, data, expiry, version) VALUES ($1, $2, $3, $4)
+ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, version = EXCLUDED.version`,
+		numbered: true,
+	},
+	"mysql": {
+		schema: `CREATE TABLE IF NOT EXISTS %[1]s (
+	id VARCHAR(128) NOT NULL PRIMARY KEY,
+	data MEDIUMBLOB NOT NULL,
+	expiry BIGINT NOT NULL,
+	version BIGINT NOT NULL DEFAULT 0,
+	INDEX %[1]s_expiry_idx (expiry)
+) ENGINE=InnoDB`,
+		upsert: `INSERT INTO %s (id, data, expiry, version) VALUES (?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry), version = VALUES(version)`,
+	},
+}
+
+// SqlStore represents a database/sql session store implementation.
+type SqlStore struct {
+	db      *sql.DB
+	dialect *dialect
+	table   string
+	maxAge  int64
+	// db is opened by New
+	ownDB bool
+
+	serializer session.Serializer
+
+	closeOnce sync.Once
+	stop      chan struct{}
+}
+
+// New creates and returns a sql session store.
+// Driver must be imported by caller, e.g. `_ "github.com/mattn/go-sqlite3"`.
+func New(config string) (*SqlStore, error) {
+	js, err := simplejson.NewJson([]byte(config))
+	if err != nil {
+		return nil, err
+	}
+
+	driver := js.Get("Driver").MustString("")
+	db, err := sql.Open(driver, js.Get("DSN").MustString(""))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewByInstance(db,
+		js.Get("Dialect").MustString(driver),
+		js.Get("Table").MustString("session"),
+		js.Get("MaxAge").MustInt64(0),
+		js.Get("GCInterval").MustInt64(60))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.ownDB = true
+
+	if s.serializer, err = session.GetSerializer(js.Get("Serializer").MustString("")); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewByInstance creates and returns a sql session store by an opened db.
+// dialect is one of sqlite3, postgres and mysql.
+// Expired rows are deleted every gcInterval seconds, 0 disables it.
+func NewByInstance(db *sql.DB, dialectName, table string, maxAge, gcInterval int64) (*SqlStore, error) {
+	d, ok := dialects[dialectName]
+	if !ok {
+		return nil, fmt.Errorf("session : sql error: unknown dialect '%s'.", dialectName)
+	}
+	// table is spliced into sql
+	if !validTable.MatchString(table) {
+		return nil, fmt.Errorf("session : sql error: invalid table '%s'.", table)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("session : sql error: ping: %w", err)
+	}
+
+	serializer, err := session.GetSerializer("")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SqlStore{
+		db:         db,
+		dialect:    d,
+		table:      table,
+		maxAge:     maxAge,
+		serializer: serializer,
+		stop:       make(chan struct{}),
+	}
+
+	if err = s.createSchema(); err != nil {
+		return nil, err
+	}
+
+	if gcInterval > 0 {
+		go s.startGC(time.Duration(gcInterval) * time.Second)
+	}
+
+	return s, nil
+}
+
+func (s *SqlStore) createSchema() error {
+	for _, stmt := range strings.Split(fmt.Sprintf(s.dialect.schema, s.table), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := s.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSerializer changes the serializer, default is session.DefaultSerializerName.
+func (s *SqlStore) SetSerializer(serializer session.Serializer) {
+	s.serializer = serializer
+}
+
+// rebind converts `?` placeholders for the dialect.
+func (s *SqlStore) rebind(query string) string {
+	if !s.dialect.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// expiry returns the unix time when a session expires, 0 means never.
+func (s *SqlStore) expiry() int64 {
+	if s.maxAge > 0 {
+		return time.Now().Unix() + s.maxAge
+	}
+	return 0
+}
+
+// Get gets value by given key in session.
+func (s *SqlStore) Get(id string) *session.Container {
+	var data []byte
+	var version int64
+	err := s.db.QueryRow(s.rebind(fmt.Sprintf("SELECT data, version FROM %s WHERE id = ? AND (expiry = 0 OR expiry > ?)", s.table)),
+		id, time.Now().Unix()).Scan(&data, &version)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("session : sql error:" + err.Error())
+		}
+		return nil
+	}
+
+	container, err := session.DecodeContainer(s.serializer, data)
+	if err != nil {
+		return nil
+	}
+	// the column is the source of truth for SetCAS
+	container.Version = version
+
+	return container
+}
+
+// Set sets value to given key in session.
+func (s *SqlStore) Set(id string, container *session.Container) error {
+	if !container.Changed {
+		return nil
+	}
+
+	bs, err := session.EncodeContainer(s.serializer, container)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(s.dialect.upsert, s.table), id, bs, s.expiry(), container.Version)
+	return err
+}
+
+// SetCAS sets value to given key in session if it isn't changed by others.
+func (s *SqlStore) SetCAS(id string, container *session.Container) error {
+	if !container.Changed {
+		return nil
+	}
+
+	next := *container
+	next.Version++
+	bs, err := session.EncodeContainer(s.serializer, &next)
+	if err != nil {
+		return err
+	}
+
+	if container.Version > 0 {
+		res, err := s.db.Exec(s.rebind(fmt.Sprintf("UPDATE %s SET data = ?, expiry = ?, version = ? WHERE id = ? AND version = ?", s.table)),
+			bs, s.expiry(), next.Version, id, container.Version)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return session.ErrConflict
+		}
+
+		container.Version = next.Version
+		return nil
+	}
+
+	// expired row is invisible to Get, so it doesn't conflict
+	if _, err = s.db.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ? AND expiry > 0 AND expiry <= ?", s.table)),
+		id, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	if _, err = s.db.Exec(s.rebind(fmt.Sprintf("INSERT INTO %s (id, data, expiry, version) VALUES (?, ?, ?, ?)", s.table)),
+		id, bs, s.expiry(), next.Version); err != nil {
+		// duplicate key, it's created by others
+		var n int
+		if s.db.QueryRow(s.rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ?", s.table)), id).Scan(&n) == nil && n > 0 {
+			return session.ErrConflict
+		}
+		return err
+	}
+
+	container.Version = next.Version
+	return nil
+}
+
+// Touch refreshes the expiry of a session, an expired one isn't revived.
+func (s *SqlStore) Touch(id string) error {
+	if s.maxAge <= 0 {
+		return nil
+	}
+
+	_, err := s.db.Exec(s.rebind(fmt.Sprintf("UPDATE %s SET expiry = ? WHERE id = ? AND expiry > ?", s.table)),
+		s.expiry(), id, time.Now().Unix())
+	return err
+}
+
+// Del deletes a key from session.
+func (s *SqlStore) Del(id string) error {
+	_, err := s.db.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table)), id)
+	return err
+}
+
+// Flush deletes all sessions.
+func (s *SqlStore) Flush() error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s", s.table))
+	return err
+}
+
+// Scan lists live sessions order by id.
+func (s *SqlStore) Scan(cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	rows, err := s.db.Query(s.rebind(fmt.Sprintf("SELECT id FROM %s WHERE id > ? AND (expiry = 0 OR expiry > ?) ORDER BY id LIMIT ?", s.table)),
+		cursor, time.Now().Unix(), limit)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0, limit)
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, "", err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(ids) < limit {
+		return ids, "", nil
+	}
+	return ids, ids[len(ids)-1], nil
+}
+
+// GC deletes expired sessions.
+func (s *SqlStore) GC() error {
+	_, err := s.db.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE expiry > 0 AND expiry <= ?", s.table)),
+		time.Now().Unix())
+	return err
+}
+
+func (s *SqlStore) startGC(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.GC(); err != nil {
+				log.Println("session : sql gc error:" + err.Error())
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops the gc routine, and closes the db if it is opened by New.
+func (s *SqlStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		if s.ownDB {
+			err = s.db.Close()
+		}
+	})
+	return err
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/meilihao/water"
+	"github.com/meilihao/water-contrib/session"
+	"github.com/meilihao/water-contrib/session/sessiontest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type Sessdata struct {
+	UserName string
+}
+
+func init() {
+	session.RegisterType(&Sessdata{})
+}
+
+func newTestStore(maxAge int64) (*SqlStore, func()) {
+	dir, err := ioutil.TempDir("", "sqlstore")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := New(fmt.Sprintf(`
+{
+    "Driver":"sqlite3",
+    "DSN":"%s",
+    "Table":"session",
+    "MaxAge":%d,
+    "GCInterval":0
+}`, filepath.Join(dir, "session.db"), maxAge))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_Session(t *testing.T) {
+	store, clean := newTestStore(0)
+	defer clean()
+
+	manager := new(session.Options)
+	manager.Generator = session.NewSha1Generator("sha1")
+	manager.Tracker = session.NewCookieTracker("session", 0, false, "/", "")
+	manager.Store = store
+
+	Convey("Basic operation", t, func() {
+		router := water.Classic()
+		router.Before(session.New(manager))
+		router.Get("/", func(ctx *water.Context) {
+			sess := session.Get(ctx)
+
+			sess.Container.Data = &Sessdata{UserName: "chen"}
+			sess.Container.Changed = true
+		})
+		router.Get("/get", func(ctx *water.Context) {
+			sess := session.Get(ctx)
+			So(sess.Id, ShouldNotBeEmpty)
+
+			sd, ok := sess.Container.Data.(*Sessdata)
+			So(ok, ShouldBeTrue)
+			So(sd.UserName, ShouldEqual, "chen")
+
+			So(sess.Del(sess.Id), ShouldBeNil)
+
+			sc := sess.Get(sess.Id)
+			So(sc.Data, ShouldBeNil)
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/", nil)
+		So(err, ShouldBeNil)
+		router.ServeHTTP(resp, req)
+
+		cookie := resp.Header().Get("Set-Cookie")
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", "/get", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		router.ServeHTTP(resp, req)
+	})
+
+	Convey("Overwrite and flush", t, func() {
+		So(store.Set("a", &session.Container{Data: "a", Changed: true}), ShouldBeNil)
+		So(store.Set("a", &session.Container{Data: "b", Changed: true}), ShouldBeNil)
+		So(store.Get("a").Data, ShouldEqual, "b")
+
+		So(store.Flush(), ShouldBeNil)
+		So(store.Get("a"), ShouldBeNil)
+	})
+}
+
+func Test_CAS(t *testing.T) {
+	store, clean := newTestStore(0)
+	defer clean()
+
+	Convey("CAS", t, func() {
+		c := &session.Container{Data: &Sessdata{UserName: "chen"}, Changed: true}
+		So(store.SetCAS("cas", c), ShouldBeNil)
+		So(c.Version, ShouldEqual, 1)
+		So(store.Get("cas").Version, ShouldEqual, 1)
+
+		stale := &session.Container{Data: &Sessdata{UserName: "li"}, Changed: true}
+		So(store.SetCAS("cas", stale), ShouldEqual, session.ErrConflict)
+
+		So(store.SetCAS("cas", c), ShouldBeNil)
+		So(c.Version, ShouldEqual, 2)
+
+		stale.Version = 1
+		So(store.SetCAS("cas", stale), ShouldEqual, session.ErrConflict)
+		So(store.Get("cas").Data.(*Sessdata).UserName, ShouldEqual, "chen")
+	})
+}
+
+func Test_Expire(t *testing.T) {
+	store, clean := newTestStore(1)
+	defer clean()
+
+	Convey("Expired session is invisible and removed by gc", t, func() {
+		So(store.Set("a", &session.Container{Data: "a", Changed: true}), ShouldBeNil)
+		So(store.Get("a"), ShouldNotBeNil)
+
+		time.Sleep(2 * time.Second)
+		So(store.Get("a"), ShouldBeNil)
+		// Touch doesn't revive it before the gc
+		So(store.Touch("a"), ShouldBeNil)
+		So(store.Get("a"), ShouldBeNil)
+
+		So(store.GC(), ShouldBeNil)
+
+		var n int
+		So(store.db.QueryRow("SELECT COUNT(*) FROM session").Scan(&n), ShouldBeNil)
+		So(n, ShouldEqual, 0)
+	})
+
+	Convey("Unknown dialect", t, func() {
+		db, err := sql.Open("sqlite3", ":memory:")
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		_, err = NewByInstance(db, "oracle", "session", 0, 0)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewByInstance(db, "sqlite3", "session;drop", 0, 0)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Ping error is kept", t, func() {
+		db, err := sql.Open("sqlite3", filepath.Join(os.TempDir(), "missing", "dir", "session.db"))
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		_, err = NewByInstance(db, "sqlite3", "session", 0, 0)
+		So(err, ShouldNotBeNil)
+		So(errors.Unwrap(err), ShouldNotBeNil)
+	})
+}
+
+func Test_Conformance(t *testing.T) {
+	sessiontest.TestStore(t, func(t *testing.T) session.Store {
+		store, clean := newTestStore(1)
+		// subtests run in order, the store is cleaned after the test
+		t.Cleanup(clean)
+		return store
+	}, sessiontest.Config{MaxAge: time.Second})
+}
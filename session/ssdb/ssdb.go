@@ -7,25 +7,43 @@
 package ssdbstore
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"fmt"
-	"reflect"
-	"unsafe"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bitly/go-simplejson"
 	"github.com/meilihao/water-contrib/session"
 	"github.com/seefan/gossdb"
 )
 
-var _ session.Store = &SsdbStore{}
+var (
+	_ session.Store    = &SsdbStore{}
+	_ session.Toucher  = &SsdbStore{}
+	_ session.CASStore = &SsdbStore{}
+	_ session.Locker   = &SsdbStore{}
+	_ session.Indexer  = &SsdbStore{}
+	_ session.Scanner  = &SsdbStore{}
+)
+
+var (
+	// LockTTL is the expiration(seconds) of a session lock in case it is never released
+	LockTTL int64 = 30
+	// CASTimeout is the max wait for the internal lock of SetCAS
+	CASTimeout = time.Second
+	// lockRetry is the interval to retry acquiring a lock
+	lockRetry = 10 * time.Millisecond
+)
 
 // SsdbStore represents a redis session store implementation.
 type SsdbStore struct {
 	prefix string
 	pool   *gossdb.Connectors
 	maxAge int64
+
+	serializer session.Serializer
 }
 
 // NewSsdbStore creates and returns a redis session store.
@@ -52,6 +70,10 @@ func New(config string) (*SsdbStore, error) {
 	ssdb.prefix = js.Get("Prefix").MustString("sssdb_")
 	ssdb.maxAge = js.Get("MaxAge").MustInt64(0)
 
+	if ssdb.serializer, err = session.GetSerializer(js.Get("Serializer").MustString("")); err != nil {
+		return nil, err
+	}
+
 	client, err := ssdb.pool.NewClient()
 	if err != nil {
 		return nil, err
@@ -65,109 +87,304 @@ func New(config string) (*SsdbStore, error) {
 	return ssdb, nil
 }
 
-func (c *SsdbStore) serialize(value interface{}) ([]byte, error) {
-	err := c.registerGobConcreteType(value)
+// SetSerializer changes the serializer, default is session.DefaultSerializerName.
+func (s *SsdbStore) SetSerializer(serializer session.Serializer) {
+	s.serializer = serializer
+}
+
+// Get gets value by given key in session.
+func (s *SsdbStore) Get(id string) *session.Container {
+	c, err := s.pool.NewClient()
 	if err != nil {
-		return nil, err
+		return nil
 	}
+	defer c.Close()
 
-	if reflect.TypeOf(value).Kind() == reflect.Struct {
-		return nil, fmt.Errorf("serialize func only take pointer of a struct")
+	v, err := c.Get(s.prefix + id)
+	if err != nil {
+		return nil
+	}
+	if v.IsEmpty() {
+		return nil
 	}
 
-	var b bytes.Buffer
-	encoder := gob.NewEncoder(&b)
-
-	err = encoder.Encode(&value)
+	container, err := session.DecodeContainer(s.serializer, v.Bytes())
 	if err != nil {
-		return nil, err
+		return nil
 	}
-	return b.Bytes(), nil
+
+	return container
 }
 
-func (c *SsdbStore) deserialize(byt []byte) (ptr interface{}, err error) {
-	b := bytes.NewBuffer(byt)
-	decoder := gob.NewDecoder(b)
+// Set sets value to given key in session.
+func (s *SsdbStore) Set(id string, container *session.Container) error {
+	if !container.Changed {
+		return nil
+	}
+
+	bs, err := session.EncodeContainer(s.serializer, container)
+	if err != nil {
+		return err
+	}
 
-	var p interface{}
-	err = decoder.Decode(&p)
+	c, err := s.pool.NewClient()
 	if err != nil {
-		return
+		return err
 	}
+	defer c.Close()
 
-	v := reflect.ValueOf(p)
-	if v.Kind() == reflect.Struct {
-		var pp interface{} = &p
-		datas := reflect.ValueOf(pp).Elem().InterfaceData()
+	return s.set(c, id, bs)
+}
 
-		sp := reflect.NewAt(v.Type(),
-			unsafe.Pointer(datas[1])).Interface()
-		ptr = sp
+func (s *SsdbStore) set(c *gossdb.Client, id string, bs []byte) error {
+	if s.maxAge > 0 {
+		return c.Set(s.prefix+id, bs, s.maxAge)
 	} else {
-		ptr = p
+		return c.Set(s.prefix+id, bs)
 	}
-	return
 }
 
-func (c *SsdbStore) registerGobConcreteType(value interface{}) error {
-	t := reflect.TypeOf(value)
+// SetCAS sets value to given key in session if it isn't changed by others.
+// ssdb has no transaction, so it's guarded by an internal lock.
+func (s *SsdbStore) SetCAS(id string, container *session.Container) error {
+	if !container.Changed {
+		return nil
+	}
 
-	switch t.Kind() {
-	case reflect.Ptr:
-		v := reflect.ValueOf(value)
-		i := v.Elem().Interface()
-		gob.Register(i)
-	case reflect.Struct, reflect.Map, reflect.Slice:
-		gob.Register(value)
-	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Bool, reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
-		// do nothing since already registered known type
-	default:
-		return fmt.Errorf("unhandled type: %v", t)
+	next := *container
+	next.Version++
+	bs, err := session.EncodeContainer(s.serializer, &next)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock("cas:"+id, CASTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c, err := s.pool.NewClient()
+	if err != nil {
+		return err
 	}
+	defer c.Close()
+
+	var version int64
+	v, err := c.Get(s.prefix + id)
+	if err != nil {
+		return err
+	}
+	if !v.IsEmpty() {
+		if version, err = session.PeekVersion(v.Bytes()); err != nil {
+			return err
+		}
+	}
+	if version != container.Version {
+		return session.ErrConflict
+	}
+
+	if err = s.set(c, id, bs); err != nil {
+		return err
+	}
+
+	container.Version = next.Version
 	return nil
 }
 
-// Get gets value by given key in session.
-func (s *SsdbStore) Get(id string) *session.Container {
+// Lock acquires the lock of a session.
+func (s *SsdbStore) Lock(id string, timeout time.Duration) (func() error, error) {
+	return s.lock("lock:"+id, timeout)
+}
+
+// lock stores "token:deadline" by setnx, setnx has no ttl in ssdb, so a lock
+// past its deadline is stolen by getset.
+func (s *SsdbStore) lock(name string, timeout time.Duration) (func() error, error) {
 	c, err := s.pool.NewClient()
 	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	key := s.prefix + name
+	token := hex.EncodeToString(session.GenRandKey(16))
+	deadline := time.Now().Add(timeout)
+
+	for {
+		value := token + ":" + strconv.FormatInt(time.Now().Unix()+LockTTL, 10)
+		resp, err := c.Do("setnx", key, value)
+		if err != nil {
+			return nil, err
+		}
+		acquired := len(resp) == 2 && resp[0] == "ok" && resp[1] == "1"
+
+		if !acquired {
+			v, err := c.Get(key)
+			if err != nil {
+				return nil, err
+			}
+			if old := v.String(); old != "" && lockExpired(old) {
+				// only the first getset sees the stale value
+				if resp, err = c.Do("getset", key, value); err != nil {
+					return nil, err
+				}
+				acquired = len(resp) == 2 && resp[0] == "ok" && resp[1] == old
+			}
+		}
+
+		if acquired {
+			// let ssdb drop the key, the lock doesn't rely on it
+			c.Expire(key, LockTTL)
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, session.ErrLockTimeout
+		}
+		time.Sleep(lockRetry)
+	}
+
+	return func() error {
+		c, err := s.pool.NewClient()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		v, err := c.Get(key)
+		if err != nil {
+			return err
+		}
+		// the lock is expired and taken by others
+		if !strings.HasPrefix(v.String(), token+":") {
+			return nil
+		}
+		return c.Del(key)
+	}, nil
+}
+
+// lockExpired reports whether the deadline of a lock value is passed.
+func lockExpired(value string) bool {
+	i := strings.LastIndexByte(value, ':')
+	if i < 0 {
+		// locked by an older version, its expire may be lost
+		return true
+	}
+	deadline, err := strconv.ParseInt(value[i+1:], 10, 64)
+	return err != nil || time.Now().Unix() > deadline
+}
+
+// Touch refreshes the ttl of a session.
+func (s *SsdbStore) Touch(id string) error {
+	if s.maxAge <= 0 {
 		return nil
 	}
+
+	c, err := s.pool.NewClient()
+	if err != nil {
+		return err
+	}
 	defer c.Close()
 
-	v, err := c.Get(s.prefix + id)
+	_, err = c.Expire(s.prefix+id, s.maxAge)
+	return err
+}
+
+// Delete delete a key from session.
+func (s *SsdbStore) Del(id string) error {
+	c, err := s.pool.NewClient()
 	if err != nil {
-		return nil
+		return err
 	}
-	if v.IsEmpty() {
-		return nil
+	defer c.Close()
+
+	return c.Del(s.prefix + id)
+}
+
+// Flush deletes all sessions and the user index with the store's prefix.
+func (s *SsdbStore) Flush() error {
+	c, err := s.pool.NewClient()
+	if err != nil {
+		return err
 	}
+	defer c.Close()
 
-	if s.maxAge > 0 {
-		_, err = c.Expire(s.prefix+id, s.maxAge)
+	// keys in (start, end]
+	start, end := s.prefix, s.prefix+"\xff"
+	for {
+		keys, err := c.Keys(start, end, 100)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = c.Del(key); err != nil {
+				return err
+			}
+		}
+
+		if len(keys) < 100 {
+			break
+		}
+		start = keys[len(keys)-1]
+	}
+
+	// the user index is in hashmaps
+	start, end = s.userKey(""), s.userKey("")+"\xff"
+	for {
+		names, err := c.Hlist(start, end, 100)
 		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err = c.Hclear(name); err != nil {
+				return err
+			}
+		}
+
+		if len(names) < 100 {
 			return nil
 		}
+		start = names[len(names)-1]
 	}
+}
 
-	value, err := s.deserialize(v.Bytes())
+// Scan lists sessions order by id, locks sharing the prefix are skipped.
+func (s *SsdbStore) Scan(cursor string, limit int) ([]string, string, error) {
+	c, err := s.pool.NewClient()
 	if err != nil {
-		return nil
+		return nil, "", err
 	}
+	defer c.Close()
 
-	return &session.Container{Data: value}
-}
+	if limit <= 0 {
+		limit = 100
+	}
+	keys, err := c.Keys(s.prefix+cursor, s.prefix+"\xff", int64(limit))
+	if err != nil {
+		return nil, "", err
+	}
 
-// Set sets value to given key in session.
-func (s *SsdbStore) Set(id string, container *session.Container) error {
-	if container.Data == nil {
-		return nil
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if id := strings.TrimPrefix(key, s.prefix); !session.IsInternalKey(id) {
+			ids = append(ids, id)
+		}
 	}
-	if !container.Changed {
-		return nil
+
+	if len(keys) < limit {
+		return ids, "", nil
 	}
+	return ids, strings.TrimPrefix(keys[len(keys)-1], s.prefix), nil
+}
 
-	bs, err := s.serialize(container.Data)
+// userKey is the hashmap of a user's sessions
+func (s *SsdbStore) userKey(userId string) string {
+	return s.prefix + "user:" + userId
+}
+
+// Bind adds the session to the user's index.
+func (s *SsdbStore) Bind(userId string, info *session.SessionInfo) error {
+	bs, err := json.Marshal(info)
 	if err != nil {
 		return err
 	}
@@ -178,24 +395,40 @@ func (s *SsdbStore) Set(id string, container *session.Container) error {
 	}
 	defer c.Close()
 
-	if s.maxAge > 0 {
-		return c.Set(s.prefix+id, bs, s.maxAge)
-	} else {
-		return c.Set(s.prefix+id, bs)
-	}
+	return c.Hset(s.userKey(userId), info.Id, bs)
 }
 
-// Delete delete a key from session.
-func (s *SsdbStore) Del(id string) error {
+// Unbind removes the session from the user's index.
+func (s *SsdbStore) Unbind(userId, id string) error {
 	c, err := s.pool.NewClient()
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	return c.Del(s.prefix + id)
+	return c.Hdel(s.userKey(userId), id)
 }
 
-func (s *SsdbStore) Flush() error {
-	return nil
+// Sessions returns the indexed sessions of a user.
+func (s *SsdbStore) Sessions(userId string) ([]*session.SessionInfo, error) {
+	c, err := s.pool.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	m, err := c.HgetAll(s.userKey(userId))
+	if err != nil {
+		return nil, err
+	}
+
+	ls := make([]*session.SessionInfo, 0, len(m))
+	for _, v := range m {
+		info := new(session.SessionInfo)
+		if err = json.Unmarshal(v.Bytes(), info); err != nil {
+			return nil, err
+		}
+		ls = append(ls, info)
+	}
+	return ls, nil
 }
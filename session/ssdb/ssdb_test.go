@@ -14,14 +14,22 @@ import (
 
 	"github.com/meilihao/water"
 	"github.com/meilihao/water-contrib/session"
+	"github.com/meilihao/water-contrib/session/sessiontest"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 var manager *session.Options
 
+type Sessdata struct {
+	UserName   string
+	CreateTime time.Time
+}
+
 func init() {
 	log.SetFlags(log.Lshortfile)
 
+	session.RegisterType(&Sessdata{})
+
 	manager = new(session.Options)
 	manager.Generator = session.NewSha1Generator("sha1")
 	manager.Tracker = session.NewCookieTracker("session", 0, false, "/", "")
@@ -61,10 +69,6 @@ func Test_Session(t *testing.T) {
 		router.ServeHTTP(resp, req)
 	})
 	Convey("Basic operation", t, func() {
-		type Sessdata struct {
-			UserName   string
-			CreateTime time.Time
-		}
 		router := water.Classic()
 		router.Before(session.New(manager))
 		router.Get("/", func(ctx *water.Context) {
@@ -122,4 +126,70 @@ func Test_Session(t *testing.T) {
 		req.Header.Set("Cookie", cookie)
 		router.ServeHTTP(resp, req)
 	})
+
+	Convey("CAS and lock", t, func() {
+		store := manager.Store.(*SsdbStore)
+
+		c := &session.Container{Data: &Sessdata{UserName: "chen"}, Changed: true}
+		So(store.SetCAS("cas", c), ShouldBeNil)
+		So(c.Version, ShouldEqual, 1)
+		So(store.Get("cas").Version, ShouldEqual, 1)
+
+		stale := &session.Container{Data: &Sessdata{UserName: "li"}, Changed: true}
+		So(store.SetCAS("cas", stale), ShouldEqual, session.ErrConflict)
+
+		So(store.SetCAS("cas", c), ShouldBeNil)
+		So(c.Version, ShouldEqual, 2)
+		So(store.Del("cas"), ShouldBeNil)
+
+		unlock, err := store.Lock("cas", time.Second)
+		So(err, ShouldBeNil)
+		_, err = store.Lock("cas", 50*time.Millisecond)
+		So(err, ShouldEqual, session.ErrLockTimeout)
+		So(unlock(), ShouldBeNil)
+
+		unlock, err = store.Lock("cas", 50*time.Millisecond)
+		So(err, ShouldBeNil)
+		So(unlock(), ShouldBeNil)
+
+		// a lock left without ttl is stolen after its deadline
+		client, err := store.pool.NewClient()
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(client.Set(store.prefix+"lock:stale", "dead:1"), ShouldBeNil)
+
+		unlock, err = store.Lock("stale", 50*time.Millisecond)
+		So(err, ShouldBeNil)
+		_, err = store.Lock("stale", 50*time.Millisecond)
+		So(err, ShouldEqual, session.ErrLockTimeout)
+		So(unlock(), ShouldBeNil)
+	})
+
+	Convey("User index", t, func() {
+		store := manager.Store.(*SsdbStore)
+
+		So(store.Bind("1", &session.SessionInfo{Id: "a", UserId: "1", UserAgent: "phone"}), ShouldBeNil)
+		So(store.Bind("1", &session.SessionInfo{Id: "b", UserId: "1", UserAgent: "laptop"}), ShouldBeNil)
+
+		ls, err := store.Sessions("1")
+		So(err, ShouldBeNil)
+		So(ls, ShouldHaveLength, 2)
+
+		So(store.Unbind("1", "a"), ShouldBeNil)
+		ls, err = store.Sessions("1")
+		So(err, ShouldBeNil)
+		So(ls, ShouldHaveLength, 1)
+		So(ls[0].UserAgent, ShouldEqual, "laptop")
+
+		So(store.Unbind("1", "b"), ShouldBeNil)
+	})
+}
+
+func Test_Conformance(t *testing.T) {
+	sessiontest.TestStore(t, func(t *testing.T) session.Store {
+		if err := manager.Store.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return manager.Store
+	}, sessiontest.Config{})
 }
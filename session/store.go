@@ -6,9 +6,55 @@
 
 package session
 
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrConflict is returned by CASStore.SetCAS when the session is changed by others.
+	ErrConflict = errors.New("session : version conflict")
+	// ErrLockTimeout is returned by Locker.Lock when the lock isn't acquired in time.
+	ErrLockTimeout = errors.New("session : lock timeout")
+)
+
 type Store interface {
 	Get(string) *Container
 	Set(string, *Container) error
 	Del(string) error
 	Flush() error
 }
+
+// Toucher is implemented by stores which can refresh the ttl of a session
+// without rewriting it, it's used for unchanged sessions.
+type Toucher interface {
+	Touch(id string) error
+}
+
+// CASStore is implemented by stores supporting optimistic concurrency.
+type CASStore interface {
+	// SetCAS stores c only if the stored version equals c.Version(0 means not
+	// stored yet), then c.Version is increased, otherwise it returns ErrConflict.
+	SetCAS(id string, c *Container) error
+}
+
+// Locker is implemented by stores supporting per-session lock.
+type Locker interface {
+	// Lock waits at most timeout for the lock of session id, the lock expires
+	// by itself in case unlock is never called.
+	Lock(id string, timeout time.Duration) (unlock func() error, err error)
+}
+
+// Scanner is implemented by stores which can list their sessions.
+type Scanner interface {
+	// Scan returns at most about limit session ids after cursor("" is the
+	// beginning), next is "" when there are no more ids.
+	Scan(cursor string, limit int) (ids []string, next string, err error)
+}
+
+// IsInternalKey reports whether a key under a store's prefix is used by the
+// store itself, e.g. locks and user index, rather than a session.
+func IsInternalKey(key string) bool {
+	return strings.HasPrefix(key, "lock:") || strings.HasPrefix(key, "cas:") || strings.HasPrefix(key, "user:")
+}
@@ -7,7 +7,11 @@
 package session
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/meilihao/water"
@@ -22,26 +26,114 @@ type Tracker interface {
 
 var _ Tracker = NewCookieTracker("session", 0, false, "/", "")
 
-// CookieTracker provide sessionid from cookie
-type CookieTracker struct {
-	Name   string
+const (
+	// cookie needs Secure
+	secureCookiePrefix = "__Secure-"
+	// cookie needs Secure, Path "/" and no Domain
+	hostCookiePrefix = "__Host-"
+)
+
+// CookieOptions is the config of CookieTracker.
+type CookieOptions struct {
+	Name string
+	// MaxAge > 0 means a persistent cookie, 0 means a session-only cookie
 	MaxAge int
 	Secure bool
 	Path   string
 	Domain string
+	// SameSite is one of http.SameSiteLaxMode, http.SameSiteStrictMode and
+	// http.SameSiteNoneMode(needs Secure), http.SameSiteDefaultMode omits it
+	SameSite http.SameSite
+	// Partitioned cookie(CHIPS) needs Secure
+	Partitioned bool
 }
 
+// Validate checks the options by the rules of cookie prefixes and attributes.
+func (opt *CookieOptions) Validate() error {
+	if opt.Name == "" {
+		return errors.New("session : cookie need name")
+	}
+	for _, r := range opt.Name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r) {
+			return fmt.Errorf("session : invalid cookie name %q", opt.Name)
+		}
+	}
+	if opt.MaxAge < 0 {
+		return errors.New("session : cookie need MaxAge >= 0")
+	}
+
+	if strings.HasPrefix(opt.Name, secureCookiePrefix) && !opt.Secure {
+		return errors.New("session : __Secure- cookie need Secure")
+	}
+	if strings.HasPrefix(opt.Name, hostCookiePrefix) {
+		if !opt.Secure || opt.Path != "/" || opt.Domain != "" {
+			return errors.New("session : __Host- cookie need Secure, Path \"/\" and no Domain")
+		}
+	}
+
+	switch opt.SameSite {
+	case http.SameSiteDefaultMode, http.SameSiteLaxMode, http.SameSiteStrictMode:
+	case http.SameSiteNoneMode:
+		if !opt.Secure {
+			return errors.New("session : SameSite=None cookie need Secure")
+		}
+	default:
+		return fmt.Errorf("session : invalid SameSite %d", opt.SameSite)
+	}
+	if opt.Partitioned && !opt.Secure {
+		return errors.New("session : partitioned cookie need Secure")
+	}
+
+	return nil
+}
+
+// CookieTracker provide sessionid from cookie
+type CookieTracker struct {
+	Name        string
+	MaxAge      int
+	Secure      bool
+	Path        string
+	Domain      string
+	SameSite    http.SameSite
+	Partitioned bool
+}
+
+// NewCookieTracker creates a tracker with SameSite=Lax, maxAge <= 0 means a
+// session-only cookie. It panics on an invalid name or prefix rule.
 func NewCookieTracker(name string, maxAge int, secure bool, path, domain string) *CookieTracker {
-	if maxAge < 1 {
-		maxAge = 100 * 365 * 24 * 60 * 60
+	if maxAge < 0 {
+		maxAge = 0
 	}
-	return &CookieTracker{
-		Name:   name,
-		MaxAge: maxAge,
-		Secure: secure,
-		Path:   path,
-		Domain: domain,
+
+	tracker, err := NewCookieTrackerWithOptions(CookieOptions{
+		Name:     name,
+		MaxAge:   maxAge,
+		Secure:   secure,
+		Path:     path,
+		Domain:   domain,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return tracker
+}
+
+// NewCookieTrackerWithOptions creates a tracker after validating the options.
+func NewCookieTrackerWithOptions(opt CookieOptions) (*CookieTracker, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, err
 	}
+
+	return &CookieTracker{
+		Name:        opt.Name,
+		MaxAge:      opt.MaxAge,
+		Secure:      opt.Secure,
+		Path:        opt.Path,
+		Domain:      opt.Domain,
+		SameSite:    opt.SameSite,
+		Partitioned: opt.Partitioned,
+	}, nil
 }
 
 func (tracker *CookieTracker) Get(ctx *water.Context) (string, error) {
@@ -58,41 +150,51 @@ func (tracker *CookieTracker) Get(ctx *water.Context) (string, error) {
 }
 
 func (tracker *CookieTracker) Set(ctx *water.Context, id string) {
-	cookie, _ := ctx.Req.Cookie(tracker.Name)
-	if cookie == nil {
-		cookie = &http.Cookie{
-			Name:     tracker.Name,
-			Value:    id,
-			Path:     tracker.Path,
-			Domain:   tracker.Domain,
-			HttpOnly: true,
-			Secure:   tracker.Secure,
-			MaxAge:   tracker.MaxAge,
-		}
-
-		ctx.Req.AddCookie(cookie)
-	} else {
-		cookie.Value = id
-	}
-	http.SetCookie(ctx.ResponseWriter, cookie)
+	tracker.write(ctx, &http.Cookie{
+		Name:   tracker.Name,
+		Value:  id,
+		MaxAge: tracker.MaxAge,
+	})
 }
 
 func (tracker *CookieTracker) Clear(ctx *water.Context) {
 	// 因为一个Cookie应当属于一个path与domain，所以删除时，Cookie的这两个属性也必须设置.
-	cookie := http.Cookie{
-		Name:     tracker.Name,
-		Path:     tracker.Path,
-		Domain:   tracker.Domain,
-		HttpOnly: true,
-		Secure:   tracker.Secure,
-		Expires:  time.Date(0, 1, 1, 0, 0, 0, 0, time.Local),
-		MaxAge:   0,
+	tracker.write(ctx, &http.Cookie{
+		Name:    tracker.Name,
+		Expires: time.Unix(0, 0),
+		MaxAge:  -1,
+	})
+}
+
+// write replaces the Set-Cookie of the same name set before in the request,
+// e.g. the session is regenerated.
+func (tracker *CookieTracker) write(ctx *water.Context, cookie *http.Cookie) {
+	cookie.Path = tracker.Path
+	cookie.Domain = tracker.Domain
+	cookie.HttpOnly = true
+	cookie.Secure = tracker.Secure
+	cookie.SameSite = tracker.SameSite
+
+	v := cookie.String()
+	if tracker.Partitioned {
+		v += "; Partitioned"
+	}
+
+	header := ctx.ResponseWriter.Header()
+	olds := header["Set-Cookie"]
+	cookies := make([]string, 0, len(olds)+1)
+	for _, old := range olds {
+		if !strings.HasPrefix(old, tracker.Name+"=") {
+			cookies = append(cookies, old)
+		}
 	}
-	http.SetCookie(ctx.ResponseWriter, &cookie)
+	header["Set-Cookie"] = append(cookies, v)
 }
 
 var _ Tracker = NewHeaderTracker("session")
 
+// HeaderTracker provide sessionid from header, and returns it by the same
+// response header.
 type HeaderTracker struct {
 	Name string
 }
@@ -112,5 +214,132 @@ func (tracker *HeaderTracker) Set(ctx *water.Context, id string) {
 	ctx.ResponseWriter.Header().Set(tracker.Name, id)
 }
 
+// Clear sends an empty header, client should drop its sessionid then.
 func (tracker *HeaderTracker) Clear(ctx *water.Context) {
+	ctx.ResponseWriter.Header().Set(tracker.Name, "")
+}
+
+var _ Tracker = NewBearerTracker("X-Session-Id")
+
+// BearerTracker provide sessionid from `Authorization: Bearer <id>`, and
+// returns it by the response header ResponseName.
+type BearerTracker struct {
+	ResponseName string
+}
+
+func NewBearerTracker(responseName string) *BearerTracker {
+	return &BearerTracker{
+		ResponseName: responseName,
+	}
+}
+
+func (tracker *BearerTracker) Get(ctx *water.Context) (string, error) {
+	auth := ctx.Req.Header.Get("Authorization")
+	// scheme is case-insensitive
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", nil
+	}
+
+	return strings.TrimSpace(auth[7:]), nil
+}
+
+func (tracker *BearerTracker) Set(ctx *water.Context, id string) {
+	ctx.ResponseWriter.Header().Set(tracker.ResponseName, id)
+}
+
+func (tracker *BearerTracker) Clear(ctx *water.Context) {
+	ctx.ResponseWriter.Header().Set(tracker.ResponseName, "")
+}
+
+var _ Tracker = NewQueryTracker("sid")
+
+// QueryTracker provide sessionid from query param, e.g. download links.
+// It's opt-in since the id in url leaks by logs and Referer, and it can't
+// set the id, so links are built by URL.
+type QueryTracker struct {
+	Name string
+}
+
+func NewQueryTracker(name string) *QueryTracker {
+	return &QueryTracker{
+		Name: name,
+	}
+}
+
+func (tracker *QueryTracker) Get(ctx *water.Context) (string, error) {
+	return ctx.Req.URL.Query().Get(tracker.Name), nil
+}
+
+func (tracker *QueryTracker) Set(ctx *water.Context, id string) {
+}
+
+func (tracker *QueryTracker) Clear(ctx *water.Context) {
+}
+
+// URL adds the sessionid to rawurl.
+func (tracker *QueryTracker) URL(rawurl, id string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set(tracker.Name, id)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+var _ Tracker = NewChainTracker(NewCookieTracker("session", 0, false, "/", ""))
+
+// ChainTracker tries its trackers in order, and sets or clears the id by the
+// tracker which provided it in the request, otherwise by the first one.
+type ChainTracker struct {
+	Trackers []Tracker
+}
+
+func NewChainTracker(trackers ...Tracker) *ChainTracker {
+	if len(trackers) == 0 {
+		panic("session : chain tracker need trackers")
+	}
+
+	return &ChainTracker{
+		Trackers: trackers,
+	}
+}
+
+func (tracker *ChainTracker) Get(ctx *water.Context) (string, error) {
+	for _, t := range tracker.Trackers {
+		id, err := t.Get(ctx)
+		if err != nil {
+			return "", err
+		}
+		if id != "" {
+			ctx.Environ.Set("SessionTracker", t)
+			return id, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Source returns the tracker which provided the id in the request, nil if
+// no one did.
+func (tracker *ChainTracker) Source(ctx *water.Context) Tracker {
+	t, _ := ctx.Environ.Get("SessionTracker").(Tracker)
+	return t
+}
+
+func (tracker *ChainTracker) source(ctx *water.Context) Tracker {
+	if t := tracker.Source(ctx); t != nil {
+		return t
+	}
+	return tracker.Trackers[0]
+}
+
+func (tracker *ChainTracker) Set(ctx *water.Context, id string) {
+	tracker.source(ctx).Set(ctx, id)
+}
+
+func (tracker *ChainTracker) Clear(ctx *water.Context) {
+	tracker.source(ctx).Clear(ctx)
 }
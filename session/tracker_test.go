@@ -0,0 +1,198 @@
+// Copyright 2016 The Water Authors
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meilihao/water"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func serveTracker(tracker Tracker, cookie string, handler func(ctx *water.Context)) []string {
+	router := water.NewRouter()
+	router.Get("/", handler)
+
+	return serve(router, "/", cookie).Header()["Set-Cookie"]
+}
+
+func Test_CookieTracker(t *testing.T) {
+	Convey("Session-only cookie", t, func() {
+		tracker := NewCookieTracker("session", 0, false, "/", "")
+
+		cookies := serveTracker(tracker, "session=old", func(ctx *water.Context) {
+			tracker.Set(ctx, "new")
+
+			// request cookie isn't changed
+			id, _ := tracker.Get(ctx)
+			So(id, ShouldEqual, "old")
+		})
+		So(cookies, ShouldResemble, []string{"session=new; Path=/; HttpOnly; SameSite=Lax"})
+	})
+
+	Convey("Persistent cookie", t, func() {
+		tracker := NewCookieTracker("session", 3600, true, "/", ".test.com")
+
+		cookies := serveTracker(tracker, "", func(ctx *water.Context) {
+			tracker.Set(ctx, "a")
+		})
+		So(cookies, ShouldResemble, []string{"session=a; Path=/; Domain=test.com; Max-Age=3600; HttpOnly; Secure; SameSite=Lax"})
+	})
+
+	Convey("Last Set-Cookie wins", t, func() {
+		tracker := NewCookieTracker("session", 0, false, "/", "")
+
+		cookies := serveTracker(tracker, "", func(ctx *water.Context) {
+			http.SetCookie(ctx.ResponseWriter, &http.Cookie{Name: "other", Value: "x"})
+			tracker.Set(ctx, "a")
+			tracker.Set(ctx, "b")
+		})
+		So(cookies, ShouldResemble, []string{"other=x", "session=b; Path=/; HttpOnly; SameSite=Lax"})
+
+		cookies = serveTracker(tracker, "", func(ctx *water.Context) {
+			tracker.Set(ctx, "a")
+			tracker.Clear(ctx)
+		})
+		So(cookies, ShouldResemble, []string{"session=; Path=/; Expires=Thu, 01 Jan 1970 00:00:00 GMT; Max-Age=0; HttpOnly; SameSite=Lax"})
+	})
+
+	Convey("SameSite and partitioned", t, func() {
+		tracker, err := NewCookieTrackerWithOptions(CookieOptions{
+			Name:        "__Host-session",
+			Secure:      true,
+			Path:        "/",
+			SameSite:    http.SameSiteNoneMode,
+			Partitioned: true,
+		})
+		So(err, ShouldBeNil)
+
+		cookies := serveTracker(tracker, "", func(ctx *water.Context) {
+			tracker.Set(ctx, "a")
+		})
+		So(cookies, ShouldResemble, []string{"__Host-session=a; Path=/; HttpOnly; Secure; SameSite=None; Partitioned"})
+
+		tracker, err = NewCookieTrackerWithOptions(CookieOptions{
+			Name:     "session",
+			Path:     "/",
+			SameSite: http.SameSiteStrictMode,
+		})
+		So(err, ShouldBeNil)
+
+		cookies = serveTracker(tracker, "", func(ctx *water.Context) {
+			tracker.Set(ctx, "a")
+		})
+		So(cookies, ShouldResemble, []string{"session=a; Path=/; HttpOnly; SameSite=Strict"})
+	})
+
+	Convey("Invalid options", t, func() {
+		for _, opt := range []CookieOptions{
+			{Name: ""},
+			{Name: "se;ssion"},
+			{Name: "session", MaxAge: -1},
+			{Name: "__Secure-session"},
+			{Name: "__Host-session", Secure: true, Path: "/", Domain: "test.com"},
+			{Name: "__Host-session", Secure: true, Path: "/a"},
+			{Name: "session", SameSite: http.SameSiteNoneMode},
+			{Name: "session", Partitioned: true},
+		} {
+			_, err := NewCookieTrackerWithOptions(opt)
+			So(err, ShouldNotBeNil)
+		}
+
+		So(func() { NewCookieTracker("__Host-session", 0, false, "/", "") }, ShouldPanic)
+		// the legacy constructor accepts a negative maxAge
+		So(NewCookieTracker("session", -1, false, "/", "").MaxAge, ShouldEqual, 0)
+	})
+}
+
+func Test_ChainTracker(t *testing.T) {
+	cookie := NewCookieTracker("session", 0, false, "/", "")
+	header := NewHeaderTracker("X-Session-Id")
+	bearer := NewBearerTracker("X-Session-Id")
+	tracker := NewChainTracker(cookie, header, bearer)
+
+	get := func(req *http.Request, handler func(ctx *water.Context)) http.Header {
+		router := water.NewRouter()
+		router.Get("/", handler)
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Header()
+	}
+
+	Convey("Cookie first", t, func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Cookie", "session=a")
+		req.Header.Set("X-Session-Id", "b")
+
+		h := get(req, func(ctx *water.Context) {
+			id, _ := tracker.Get(ctx)
+			So(id, ShouldEqual, "a")
+			So(tracker.Source(ctx), ShouldEqual, cookie)
+
+			tracker.Set(ctx, "c")
+		})
+		So(h.Get("Set-Cookie"), ShouldStartWith, "session=c;")
+		So(h.Get("X-Session-Id"), ShouldBeEmpty)
+	})
+
+	Convey("Header and bearer", t, func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Session-Id", "b")
+
+		h := get(req, func(ctx *water.Context) {
+			id, _ := tracker.Get(ctx)
+			So(id, ShouldEqual, "b")
+			So(tracker.Source(ctx), ShouldEqual, header)
+
+			tracker.Clear(ctx)
+		})
+		So(h["X-Session-Id"], ShouldResemble, []string{""})
+		So(h.Get("Set-Cookie"), ShouldBeEmpty)
+
+		req, _ = http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "bearer  token ")
+
+		h = get(req, func(ctx *water.Context) {
+			id, _ := tracker.Get(ctx)
+			So(id, ShouldEqual, "token")
+			So(tracker.Source(ctx), ShouldEqual, bearer)
+
+			tracker.Set(ctx, "d")
+		})
+		So(h.Get("X-Session-Id"), ShouldEqual, "d")
+	})
+
+	Convey("New client uses the first tracker", t, func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+
+		h := get(req, func(ctx *water.Context) {
+			id, _ := tracker.Get(ctx)
+			So(id, ShouldBeEmpty)
+			So(tracker.Source(ctx), ShouldBeNil)
+
+			tracker.Set(ctx, "e")
+		})
+		So(h.Get("Set-Cookie"), ShouldStartWith, "session=e;")
+	})
+
+	Convey("Query param", t, func() {
+		query := NewQueryTracker("sid")
+
+		link, err := query.URL("/download?file=a.zip", "f")
+		So(err, ShouldBeNil)
+		So(link, ShouldEqual, "/download?file=a.zip&sid=f")
+
+		req, _ := http.NewRequest("GET", link, nil)
+		get(req, func(ctx *water.Context) {
+			id, _ := NewChainTracker(cookie, query).Get(ctx)
+			So(id, ShouldEqual, "f")
+		})
+	})
+}